@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// emptyJSON is the config of artifacts, see
+// https://github.com/opencontainers/image-spec/blob/main/manifest.md#guidance-for-an-empty-descriptor.
+var emptyJSON = []byte("{}")
+
+// artifactBlob is a single file of an artifact.
+type artifactBlob struct {
+	mediaType   types.MediaType
+	data        []byte
+	annotations map[string]string
+}
+
+// artifact is an OCI image manifest that carries arbitrary files instead of an image. Its type is the media
+// type of the config, whose content is always empty. This is the pre OCI 1.1 way of declaring an artifact
+// type, which is understood by all registries and by the referrers tag schema fallback.
+type artifact struct {
+	manifest []byte
+	config   v1.Layer
+	layers   []v1.Layer
+}
+
+var _ partial.CompressedImageCore = (*artifact)(nil)
+
+// newArtifact creates an artifact of the given type that contains the given blobs. If subject is set, the
+// artifact is a referrer of it.
+func newArtifact(artifactType types.MediaType, blobs []artifactBlob, subject *v1.Descriptor, annotations map[string]string) (v1.Image, error) {
+	a := &artifact{
+		config: static.NewLayer(emptyJSON, artifactType),
+	}
+	configDesc, err := partial.Descriptor(a.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe artifact config: %w", err)
+	}
+
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config:        *configDesc,
+		Layers:        []v1.Descriptor{},
+		Annotations:   annotations,
+	}
+	if subject != nil {
+		manifest.Subject = &v1.Descriptor{
+			MediaType: subject.MediaType,
+			Size:      subject.Size,
+			Digest:    subject.Digest,
+		}
+	}
+	for _, blob := range blobs {
+		layer := static.NewLayer(blob.data, blob.mediaType)
+		desc, err := partial.Descriptor(layer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe artifact blob: %w", err)
+		}
+		desc.Annotations = blob.annotations
+		manifest.Layers = append(manifest.Layers, *desc)
+		a.layers = append(a.layers, layer)
+	}
+
+	a.manifest, err = json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal artifact manifest: %w", err)
+	}
+
+	return partial.CompressedToImage(a)
+}
+
+func (a *artifact) RawConfigFile() ([]byte, error) {
+	return emptyJSON, nil
+}
+
+func (a *artifact) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func (a *artifact) RawManifest() ([]byte, error) {
+	return a.manifest, nil
+}
+
+func (a *artifact) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, layer := range append([]v1.Layer{a.config}, a.layers...) {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if digest == h {
+			return layer, nil
+		}
+	}
+	return nil, fmt.Errorf("blob %s not found in artifact", h)
+}
+
+// pushArtifact pushes the artifact by digest to the given repository. If the artifact has a subject and the
+// registry does not support the referrers API, the referrers tag of the subject is updated instead.
+func pushArtifact(ctx context.Context, repo name.Repository, art v1.Image) error {
+	digest, err := art.Digest()
+	if err != nil {
+		return fmt.Errorf("failed to compute artifact digest: %w", err)
+	}
+	ref := repo.Digest(digest.String())
+
+	slog.Info("pushing artifact to registry", "ref", ref.String())
+	if err := remote.Write(ref, art, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+		return fmt.Errorf("failed to push artifact: %w", err)
+	}
+	return nil
+}
+
+// pushArtifacts pushes the artifacts to every repository of the given references.
+func pushArtifacts(ctx context.Context, refs []name.Reference, arts ...v1.Image) error {
+	for _, repo := range repositories(refs) {
+		for _, art := range arts {
+			if err := pushArtifact(ctx, repo, art); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const (
+	baseImagePrefixTarball = "tarball:"
+	baseImagePrefixOCI     = "oci:"
+)
+
+// baseImagePlatform returns the platform to select from multi-platform base images. Without an explicit
+// platform, the service's GOOS/GOARCH are used, falling back to the host platform like go build does.
+func baseImagePlatform(svc ConfigService, platform *v1.Platform) v1.Platform {
+	if platform != nil {
+		return *platform
+	}
+	return v1.Platform{
+		OS:           cmp.Or(svc.GOOS, runtime.GOOS),
+		Architecture: cmp.Or(svc.GOARCH, runtime.GOARCH),
+	}
+}
+
+// loadBaseImage loads the base image from a docker tarball (tarball:<file>), an OCI image layout directory
+// (oci:<dir>) or a registry reference. Paths are relative to the project root.
+func loadBaseImage(ctx context.Context, ref, projectRoot string, platform v1.Platform) (v1.Image, error) {
+	resolvePath := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(projectRoot, path)
+	}
+
+	switch {
+	case strings.HasPrefix(ref, baseImagePrefixTarball):
+		path := resolvePath(strings.TrimPrefix(ref, baseImagePrefixTarball))
+		image, err := tarball.ImageFromPath(path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load base image from tarball %s: %w", path, err)
+		}
+		return image, nil
+
+	case strings.HasPrefix(ref, baseImagePrefixOCI):
+		path := resolvePath(strings.TrimPrefix(ref, baseImagePrefixOCI))
+		index, err := layout.ImageIndexFromPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load base image from OCI image layout %s: %w", path, err)
+		}
+		image, err := selectImage(index, platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select base image from OCI image layout %s: %w", path, err)
+		}
+		return image, nil
+
+	default:
+		parsed, err := name.ParseReference(ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse base image reference: %w", err)
+		}
+		image, err := remote.Image(parsed,
+			remote.WithContext(ctx),
+			remote.WithAuthFromKeychain(authn.DefaultKeychain),
+			remote.WithPlatform(platform),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pull base image %s: %w", ref, err)
+		}
+		return image, nil
+	}
+}
+
+// selectImage returns the only image in the index, including nested indexes, that matches the platform.
+// Images without a platform in their descriptor match any platform.
+func selectImage(index v1.ImageIndex, platform v1.Platform) (v1.Image, error) {
+	var matches []v1.Image
+
+	var walk func(index v1.ImageIndex) error
+	walk = func(index v1.ImageIndex) error {
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, desc := range manifest.Manifests {
+			switch {
+			case desc.MediaType.IsIndex():
+				child, err := index.ImageIndex(desc.Digest)
+				if err != nil {
+					return err
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			case desc.MediaType.IsImage():
+				if desc.Platform != nil && !desc.Platform.Satisfies(platform) {
+					continue
+				}
+				image, err := index.Image(desc.Digest)
+				if err != nil {
+					return err
+				}
+				matches = append(matches, image)
+			}
+		}
+		return nil
+	}
+	if err := walk(index); err != nil {
+		return nil, err
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no image found for platform %s", platform.String())
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("multiple images found for platform %s", platform.String())
+	}
+}
@@ -3,24 +3,37 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto"
 	"fmt"
 	"io"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/urfave/cli/v3"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	binaryLayersSingle     = "single"
+	binaryLayersPerService = "perService"
 )
 
 var buildCmd = &cli.Command{
@@ -28,11 +41,13 @@ var buildCmd = &cli.Command{
 	Usage:  "build a binary into a docker image",
 	Action: buildAction,
 	Flags: []cli.Flag{
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:    "tag",
 			Aliases: []string{"t"},
-			Usage:   "tag to use for the output image",
-			Value:   "bespoke:latest",
+			Usage: `
+				Tag template to use for the output image, can be repeated (default: bespoke:{{.Tag}}, or {{.Name}}:{{.Tag}} for per-service images).
+				Available variables: {{.Name}}, {{.Tag}}, {{.Date}}, {{.Commit}}, {{.ShortSHA}}, {{.Branch}} and {{.Describe}}.
+			`,
 		},
 		&cli.StringFlag{
 			Name:    "out",
@@ -41,9 +56,74 @@ var buildCmd = &cli.Command{
 			Value:   "out.tar",
 		},
 		&cli.StringFlag{
+			Name:  "format",
+			Usage: "output format, either docker (tarball) or oci (image layout directory), defaults to oci for multi-platform builds",
+			Value: outputFormatDocker,
+		},
+		&cli.BoolFlag{
+			Name:  "append",
+			Usage: "append to an existing OCI image layout instead of replacing its index",
+		},
+		&cli.IntFlag{
+			Name:    "jobs",
+			Aliases: []string{"j"},
+			Usage:   "maximum number of binaries to build concurrently (default: jobs from config or number of CPUs)",
+		},
+		&cli.StringSliceFlag{
+			Name:    "service",
+			Aliases: []string{"s"},
+			Usage:   "only build the services whose names match the given glob pattern (example: api-*), can be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "entrypoint",
+			Usage: "name of the service that is the image's entrypoint (default: the service with default = true, or the first service)",
+		},
+		&cli.BoolFlag{
+			Name:  "per-service",
+			Usage: "build a separate image for every service instead of one image containing all services",
+		},
+		&cli.StringFlag{
+			Name: "binary-layers",
+			Usage: `
+				Layering strategy for binaries, either single (one layer for all binaries) or perService (one layer per binary).
+				With perService, unchanged binaries keep their layer digest, so that registries and nodes can reuse them.
+				Note that go build stamps VCS information into binaries, which can be disabled with -buildvcs=false.
+			`,
+		},
+		&cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "rebuild all binaries instead of reusing unchanged ones from the cache (BESPOKE_CACHE_DIR)",
+		},
+		&cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "build bit-for-bit reproducible images, using SOURCE_DATE_EPOCH as the creation time",
+		},
+		&cli.StringSliceFlag{
+			Name: "sbom",
+			Usage: `
+				Generate an SBOM of all services and the CA bundle in the given format, either spdx or cyclonedx, can be repeated (default: sbom from config).
+				SBOMs are written next to the output (example: out.spdx.json) or, when pushing, attached to the image as referrer artifacts.
+			`,
+		},
+		&cli.BoolFlag{
+			Name:  "provenance",
+			Usage: "record SLSA provenance next to the output (example: out.provenance.json) or, when pushing, attach it to the image (signed if sign-key is set)",
+		},
+		&cli.StringFlag{
+			Name:  "sign-key",
+			Usage: "sign pushed images with the given PEM encoded ECDSA or ed25519 private key, in a format compatible with cosign (default: BESPOKE_SIGNING_KEY when pushing)",
+		},
+		&cli.StringFlag{
+			Name:  "image-tag",
+			Usage: "value of {{.Tag}} in tag and push templates",
+			Value: "latest",
+		},
+		&cli.StringSliceFlag{
 			Name: "push",
 			Usage: `
 				Push the image to a registry (example: europe-west1-docker.pkg.dev/your-project/your-registry/image:latest).
+				The reference is a template with the same variables as tag, which allows pushing per-service images (example: registry/repo/{{.Name}}:{{.Tag}}).
+				Can be repeated, in which case the image is pushed once and then tagged with all other references.
 				Requires docker credentials to be set up, e.g. via "$HOME/.docker/config.json" or "$DOCKER_CONFIG/config.json".
 				See https://pkg.go.dev/github.com/google/go-containerregistry/pkg/authn for more information.
 			`,
@@ -52,75 +132,764 @@ var buildCmd = &cli.Command{
 }
 
 func buildAction(ctx context.Context, c *cli.Command) error {
+	startedOn := time.Now().UTC()
+
 	if c.IsSet("push") && c.IsSet("out") {
 		return fmt.Errorf("push and out flags cannot be used together")
 	}
 
+	var signKey crypto.Signer
+	signKeyPath := c.String("sign-key")
+	if signKeyPath != "" && !c.IsSet("push") {
+		return fmt.Errorf("images can only be signed when pushing")
+	}
+	if signKeyPath == "" && c.IsSet("push") {
+		// the environment is usually shared by all builds, e.g. in CI, so it only applies to pushed images
+		signKeyPath = os.Getenv("BESPOKE_SIGNING_KEY")
+	}
+	if signKeyPath != "" {
+		key, err := loadSigningKey(signKeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load signing key: %w", err)
+		}
+		signKey = key
+	}
+
 	cfg, err := loadConfig(c)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	if len(cfg.Services) == 0 {
-		return fmt.Errorf("no services found in config")
+	if err := validateConfig(ctx, cfg); err != nil {
+		return err
+	}
+
+	perService := cfg.PerServiceImages || c.Bool("per-service")
+	services, err := buildServices(cfg.mergedServices(), c.StringSlice("service"), c.String("entrypoint"), perService)
+	if err != nil {
+		return err
+	}
+
+	platforms, err := resolvePlatforms(services)
+	if err != nil {
+		return fmt.Errorf("failed to resolve platforms: %w", err)
+	}
+
+	jobs := cfg.Jobs
+	if c.IsSet("jobs") {
+		jobs = int(c.Int("jobs"))
+	}
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	reproducible := cfg.Reproducible || c.Bool("reproducible")
+	created, err := buildTime(reproducible)
+	if err != nil {
+		return err
+	}
+
+	sbomFormats := cfg.SBOM
+	if c.IsSet("sbom") {
+		sbomFormats = c.StringSlice("sbom")
+	}
+	for _, format := range sbomFormats {
+		if format != sbomFormatSPDX && format != sbomFormatCycloneDX {
+			return fmt.Errorf("unknown SBOM format %q", format)
+		}
 	}
 
-	// build binaries
 	var (
-		svcNames []string
-		binaries []string
+		caLayer  v1.Layer
+		caBundle []byte
 	)
-	for _, service := range cfg.Services {
-		service.ConfigDefaults = cfg.Defaults.merge(service.ConfigDefaults)
-		binary, err := buildBinary(ctx, service, cfg.ProjectRoot)
+	if !cfg.WithoutCABundle {
+		caLayer, caBundle, err = createCACertsLayer(ctx, cfg.CABundle, cfg.ProjectRoot, created)
 		if err != nil {
-			return fmt.Errorf("failed to build binary: %w", err)
+			return fmt.Errorf("failed to create CA certs layer: %w", err)
+		}
+	}
+
+	binaryLayers := cmp.Or(c.String("binary-layers"), cfg.BinaryLayers, binaryLayersSingle)
+	if binaryLayers != binaryLayersSingle && binaryLayers != binaryLayersPerService {
+		return fmt.Errorf("unknown binary layering strategy %q", binaryLayers)
+	}
+
+	imgOpts := imageOptions{
+		caLayer:        caLayer,
+		created:        created,
+		layerPerBinary: binaryLayers == binaryLayersPerService,
+	}
+
+	git := sync.OnceValues(func() (gitInfo, error) {
+		return readGitInfo(ctx, cfg.ProjectRoot)
+	})
+
+	cacheDir, err := binaryCacheDir()
+	if err != nil {
+		slog.Warn("failed to determine cache directory, building without cache", "error", err)
+	}
+
+	binOpts := binaryOptions{
+		projectRoot:  cfg.ProjectRoot,
+		reproducible: reproducible,
+		buildTime:    created,
+		git:          git,
+		cacheDir:     cacheDir,
+		noCache:      c.Bool("no-cache"),
+	}
+	binaries, err := buildBinaries(ctx, services, platforms, binOpts, jobs)
+	if err != nil {
+		return err
+	}
+	defer removeBinaries(binaries)
+	if cacheDir != "" {
+		if err := pruneBinaryCache(cacheDir, binaryCacheMaxAge, time.Now()); err != nil {
+			slog.Warn("failed to prune binary cache", "error", err)
+		}
+	}
+
+	// group services into images, either all services into one image or one image per service
+	groups := [][]int{make([]int, len(services))}
+	for i := range services {
+		groups[0][i] = i
+	}
+	if perService {
+		groups = nil
+		for i := range services {
+			groups = append(groups, []int{i})
+		}
+	}
+
+	var outputs []imageOutput
+	for _, group := range groups {
+		groupServices := make([]ConfigService, len(group))
+		for i, j := range group {
+			groupServices[i] = services[j]
+		}
+
+		filesLayer, err := createFilesLayer(groupServices, cfg.ProjectRoot, created)
+		if err != nil {
+			return fmt.Errorf("failed to create files layer: %w", err)
+		}
+
+		// build one image per platform
+		var (
+			images         []v1.Image
+			outputBinaries [][]builtBinary
+		)
+		for i, platform := range platforms {
+			groupBinaries := make([]builtBinary, len(group))
+			for k, j := range group {
+				groupBinaries[k] = binaries[i][j]
+			}
+			outputBinaries = append(outputBinaries, groupBinaries)
+
+			base := empty.Image
+			if groupServices[0].BaseImage != "" {
+				base, err = loadBaseImage(ctx, groupServices[0].BaseImage, cfg.ProjectRoot, baseImagePlatform(groupServices[0], platform))
+				if err != nil {
+					return fmt.Errorf("failed to load base image: %w", err)
+				}
+			}
+
+			image, err := buildImage(base, groupServices, groupBinaries, filesLayer, platform, imgOpts)
+			if err != nil {
+				return err
+			}
+			images = append(images, image)
 		}
+
+		output := imageOutput{name: groupServices[0].Name, services: groupServices, binaries: outputBinaries}
+		if len(images) > 1 {
+			output.index, err = buildIndex(images, platforms)
+			if err != nil {
+				return fmt.Errorf("failed to build image index: %w", err)
+			}
+		} else {
+			output.image = images[0]
+		}
+		outputs = append(outputs, output)
+	}
+
+	data := refTemplateData{
+		Tag:  c.String("image-tag"),
+		Date: created.Format("20060102"),
+		git:  git,
+	}
+	refs, err := writeOutputs(ctx, c, outputs, perService, data)
+	if err != nil {
+		return err
+	}
+
+	if signKey != nil {
+		if err := signOutputs(ctx, outputs, refs, signKey, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+			return fmt.Errorf("failed to sign images: %w", err)
+		}
+	}
+
+	if len(sbomFormats) != 0 {
+		if err := writeSBOMs(ctx, outputs, refs, sbomFormats, c.String("out"), created, caBundle); err != nil {
+			return fmt.Errorf("failed to write SBOMs: %w", err)
+		}
+	}
+
+	if cfg.Provenance || c.Bool("provenance") {
+		provOpts := provenanceOptions{
+			configPath: cfg.path,
+			config:     cfg.raw,
+			profile:    cfg.profile,
+			git:        git,
+			startedOn:  startedOn,
+		}
+		if err := writeProvenance(ctx, outputs, refs, provOpts, c.String("out"), signKey); err != nil {
+			return fmt.Errorf("failed to write provenance: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// buildServices returns the selected services in build order. Per-service images have no shared entrypoint,
+// so the entrypoint is only resolved when all services go into one image.
+func buildServices(services []ConfigService, patterns []string, entrypoint string, perService bool) ([]ConfigService, error) {
+	selected, err := selectServices(services, patterns)
+	if err != nil {
+		return nil, err
+	}
+	if perService {
+		if entrypoint != "" {
+			return nil, fmt.Errorf("entrypoint cannot be set for per-service images, every service is the entrypoint of its image")
+		}
+		return selected, nil
+	}
+	return entrypointFirst(selected, services, entrypoint)
+}
+
+// selectServices returns the services whose names match any of the glob patterns, in the order of the
+// config. All services are returned if there are no patterns. Every pattern has to match a service, so that
+// typos do not go unnoticed.
+func selectServices(services []ConfigService, patterns []string) ([]ConfigService, error) {
+	if len(patterns) == 0 {
+		return services, nil
+	}
+
+	var (
+		selected []ConfigService
+		matched  = make([]bool, len(patterns))
+	)
+	for _, service := range services {
+		match := false
+		for i, pattern := range patterns {
+			ok, err := path.Match(pattern, service.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid service pattern %q: %w", pattern, err)
+			}
+			if ok {
+				matched[i], match = true, true
+			}
+		}
+		if match {
+			selected = append(selected, service)
+		}
+	}
+
+	for i, pattern := range patterns {
+		if !matched[i] {
+			return nil, fmt.Errorf("no service matches %q", pattern)
+		}
+	}
+	return selected, nil
+}
+
+// entrypointFirst moves the entrypoint to the front of the selected services, as the first service of an
+// image is its entrypoint. The entrypoint is the given one or the service marked as default in the config.
+// If neither exists, the order is kept.
+func entrypointFirst(selected, all []ConfigService, entrypoint string) ([]ConfigService, error) {
+	if entrypoint == "" {
+		i := slices.IndexFunc(all, func(s ConfigService) bool { return s.Default })
+		if i < 0 {
+			return selected, nil
+		}
+		entrypoint = all[i].Name
+
+		if !slices.ContainsFunc(selected, func(s ConfigService) bool { return s.Name == entrypoint }) {
+			if len(selected) > 1 {
+				return nil, fmt.Errorf("default service %s is not selected, choose the entrypoint with --entrypoint", entrypoint)
+			}
+			return selected, nil
+		}
+	}
+
+	i := slices.IndexFunc(selected, func(s ConfigService) bool { return s.Name == entrypoint })
+	if i < 0 {
+		return nil, fmt.Errorf("entrypoint %s is not a selected service", entrypoint)
+	}
+	return slices.Concat(selected[i:i+1], selected[:i], selected[i+1:]), nil
+}
+
+// resolvePlatforms returns the platforms the image has to be built for. All services have to agree on the
+// same list of platforms, as every platform image contains all services. A single nil platform is returned
+// if no service defines platforms, in which case GOOS/GOARCH of each service are used as is.
+func resolvePlatforms(services []ConfigService) ([]*v1.Platform, error) {
+	var (
+		platforms []*v1.Platform
+		source    string
+	)
+	for i, service := range services {
+		var parsed []*v1.Platform
+		if service.Platforms != nil {
+			for _, s := range *service.Platforms {
+				platform, err := v1.ParsePlatform(s)
+				if err != nil {
+					return nil, fmt.Errorf("service %s: invalid platform %q: %w", service.Name, s, err)
+				}
+				if platform.OS == "" || platform.Architecture == "" {
+					return nil, fmt.Errorf("service %s: platform %q must specify os and architecture", service.Name, s)
+				}
+				if slices.ContainsFunc(parsed, func(p *v1.Platform) bool { return p.Equals(*platform) }) {
+					return nil, fmt.Errorf("service %s: duplicate platform %q", service.Name, s)
+				}
+				parsed = append(parsed, platform)
+			}
+		}
+
+		if i == 0 {
+			platforms, source = parsed, service.Name
+			continue
+		}
+		equal := slices.EqualFunc(platforms, parsed, func(a, b *v1.Platform) bool { return a.Equals(*b) })
+		if !equal {
+			return nil, fmt.Errorf("services %s and %s must be built for the same platforms", source, service.Name)
+		}
+	}
+
+	if len(platforms) == 0 {
+		return []*v1.Platform{nil}, nil
+	}
+	return platforms, nil
+}
+
+// buildBinaries compiles all services for all platforms with up to jobs builds running concurrently. The
+// returned binaries are indexed by platform and then by service. If one build fails, all remaining builds
+// are canceled.
+func buildBinaries(ctx context.Context, services []ConfigService, platforms []*v1.Platform, opts binaryOptions, jobs int) ([][]builtBinary, error) {
+	binaries := make([][]builtBinary, len(platforms))
+	for i := range platforms {
+		binaries[i] = make([]builtBinary, len(services))
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+
+	for i, platform := range platforms {
+		for j, service := range services {
+			g.Go(func() error {
+				binary, err := buildBinary(ctx, service, platform, opts)
+				if err != nil {
+					return fmt.Errorf("failed to build binary for service %s: %w", service.Name, err)
+				}
+				binaries[i][j] = binary
+				return nil
+			})
+		}
+	}
+
+	if err := g.Wait(); err != nil {
+		removeBinaries(binaries)
+		return nil, err
+	}
+
+	return binaries, nil
+}
+
+// removeBinaries deletes the temporary files of built binaries.
+func removeBinaries(binaries [][]builtBinary) {
+	for _, platformBinaries := range binaries {
+		for _, binary := range platformBinaries {
+			if binary.path != "" {
+				_ = os.Remove(binary.path)
+			}
+		}
+	}
+}
+
+// imageOptions are image settings that apply to all images.
+type imageOptions struct {
+	caLayer        v1.Layer  // optional, shared between images
+	created        time.Time // creation time of the image and modification time of all files
+	layerPerBinary bool      // add every binary as its own layer instead of one layer for all
+}
+
+// buildImage creates an image containing the given services on top of base. filesLayer is optional and
+// can be shared between images.
+func buildImage(base v1.Image, services []ConfigService, binaries []builtBinary, filesLayer v1.Layer, platform *v1.Platform, opts imageOptions) (v1.Image, error) {
+	var svcNames, binaryPaths []string
+	for i, service := range services {
 		svcNames = append(svcNames, service.Name)
-		binaries = append(binaries, binary)
+		binaryPaths = append(binaryPaths, binaries[i].path)
 	}
 
 	// build image
-	image := empty.Image
-	image, err = addBinariesLayer(image, svcNames, binaries)
+	image, err := addBinariesLayer(base, svcNames, binaryPaths, opts)
 	if err != nil {
-		return fmt.Errorf("failed to add binaries layer: %w", err)
+		return nil, fmt.Errorf("failed to add binaries layer: %w", err)
 	}
-	if !cfg.WithoutCABundle {
-		image, err = addCACertsLayer(image)
+	if filesLayer != nil {
+		image, err = mutate.AppendLayers(image, filesLayer)
 		if err != nil {
-			return fmt.Errorf("failed to add CA certs layer: %w", err)
+			return nil, fmt.Errorf("failed to add files layer: %w", err)
+		}
+	}
+	if services[0].Image.UserName != "" {
+		userLayer, err := createUserLayer(image, services[0].Image, opts.created)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create user layer: %w", err)
+		}
+		image, err = mutate.AppendLayers(image, userLayer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add user layer: %w", err)
+		}
+	}
+	image, err = applyImageConfig(image, services[0].Image) // first service is the entrypoint
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply image config: %w", err)
+	}
+	if opts.caLayer != nil {
+		image, err = mutate.AppendLayers(image, opts.caLayer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add CA certs layer: %w", err)
+		}
+	}
+	if platform != nil {
+		image, err = setPlatform(image, *platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set platform: %w", err)
+		}
+	}
+	image, err = setCreated(image, opts.created)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set creation time: %w", err)
+	}
+
+	return image, nil
+}
+
+func setPlatform(image v1.Image, platform v1.Platform) (v1.Image, error) {
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config file: %w", err)
+	}
+	cf = cf.DeepCopy()
+	cf.OS = platform.OS
+	cf.Architecture = platform.Architecture
+	cf.Variant = platform.Variant
+	cf.OSVersion = platform.OSVersion
+	cf.OSFeatures = platform.OSFeatures
+	return mutate.ConfigFile(image, cf)
+}
+
+// applyImageConfig sets all configured values on the image config. The entrypoint is kept as is. Env,
+// labels and exposed ports are added to the ones inherited from the base image, all other values replace
+// them.
+func applyImageConfig(image v1.Image, cfg ConfigImage) (v1.Image, error) {
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config file: %w", err)
+	}
+	cf = cf.DeepCopy()
+
+	if cfg.Env != nil {
+		for _, env := range *cfg.Env {
+			if !strings.Contains(env, "=") {
+				return nil, fmt.Errorf("invalid env %q: expected KEY=value", env)
+			}
+		}
+		cf.Config.Env = mergeEnv(cf.Config.Env, *cfg.Env)
+	}
+	if cfg.Cmd != nil {
+		cf.Config.Cmd = *cfg.Cmd
+	}
+	if cfg.WorkingDir != "" {
+		cf.Config.WorkingDir = cfg.WorkingDir
+	}
+	if cfg.UserName != "" {
+		uid, gid := cfg.ids()
+		cf.Config.User = fmt.Sprintf("%d:%d", uid, gid) // numeric, so that runtimes can verify non-root users
+	}
+	if cfg.User != "" {
+		cf.Config.User = cfg.User
+	}
+	if cfg.ExposedPorts != nil {
+		if cf.Config.ExposedPorts == nil {
+			cf.Config.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range *cfg.ExposedPorts {
+			number, proto, _ := strings.Cut(port, "/")
+			if _, err := strconv.ParseUint(number, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid exposed port %q: %w", port, err)
+			}
+			switch proto {
+			case "":
+				proto = "tcp"
+			case "tcp", "udp", "sctp":
+			default:
+				return nil, fmt.Errorf("invalid exposed port %q: unknown protocol %s", port, proto)
+			}
+			cf.Config.ExposedPorts[number+"/"+proto] = struct{}{}
+		}
+	}
+	if cfg.StopSignal != "" {
+		cf.Config.StopSignal = cfg.StopSignal
+	}
+	if cfg.Labels != nil {
+		if cf.Config.Labels == nil {
+			cf.Config.Labels = make(map[string]string)
+		}
+		for _, label := range *cfg.Labels {
+			key, value, ok := strings.Cut(label, "=")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("invalid label %q: expected key=value", label)
+			}
+			cf.Config.Labels[key] = value
 		}
 	}
 
-	if c.String("push") != "" {
-		// push image to registry
+	return mutate.ConfigFile(image, cf)
+}
 
-		slog.Info("pushing image to registry", "ref", c.String("push"))
+// mergeEnv returns base with all variables of override added. Variables that exist in both are replaced in
+// place.
+func mergeEnv(base, override []string) []string {
+	merged := slices.Clone(base)
+	for _, env := range override {
+		key, _, _ := strings.Cut(env, "=")
+		i := slices.IndexFunc(merged, func(e string) bool { return strings.HasPrefix(e, key+"=") })
+		if i >= 0 {
+			merged[i] = env
+		} else {
+			merged = append(merged, env)
+		}
+	}
+	return merged
+}
 
-		ref, err := name.ParseReference(c.String("push"))
+// setCreated sets the creation time of the image and of all its history entries.
+func setCreated(image v1.Image, created time.Time) (v1.Image, error) {
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config file: %w", err)
+	}
+	cf = cf.DeepCopy()
+	cf.Created = v1.Time{Time: created}
+	for i := range cf.History {
+		cf.History[i].Created = v1.Time{Time: created}
+	}
+	return mutate.ConfigFile(image, cf)
+}
+
+func buildIndex(images []v1.Image, platforms []*v1.Platform) (v1.ImageIndex, error) {
+	if len(images) != len(platforms) {
+		panic("images and platforms must have the same length")
+	}
+
+	index := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	for i, image := range images {
+		// manifests inside an OCI index should be OCI manifests as well
+		image, err := ociImage(image)
 		if err != nil {
-			return fmt.Errorf("failed to parse reference: %w", err)
+			return nil, err
 		}
-		if err := remote.Write(ref, image, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
-			return fmt.Errorf("failed to push image to registry: %w", err)
+
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add: image,
+			Descriptor: v1.Descriptor{
+				Platform: platforms[i],
+			},
+		})
+	}
+
+	return index, nil
+}
+
+// ociImage converts the manifest, config and layer media types of an image, which are Docker media types for
+// images built from scratch and possibly for base images, to their OCI counterparts. The layers themselves and
+// thus their digests are kept.
+func ociImage(image v1.Image) (v1.Image, error) {
+	manifest, err := image.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config file: %w", err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layers: %w", err)
+	}
+
+	addenda := make([]mutate.Addendum, len(layers))
+	for i, layer := range layers {
+		desc := manifest.Layers[i]
+		mediaType := ociLayerMediaType(desc.MediaType)
+		addenda[i] = mutate.Addendum{
+			Layer:       mediaTypeLayer{Layer: layer, mediaType: mediaType},
+			URLs:        desc.URLs,
+			Annotations: desc.Annotations,
+			MediaType:   mediaType,
 		}
-	} else {
-		// write image to file
+	}
+
+	converted := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	converted, err = mutate.Append(converted, addenda...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert layers: %w", err)
+	}
+	converted, err = mutate.ConfigFile(converted, cf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert config: %w", err)
+	}
+	if len(manifest.Annotations) > 0 {
+		converted = mutate.Annotations(converted, manifest.Annotations).(v1.Image)
+	}
+	return converted, nil
+}
+
+// mediaTypeLayer overrides the media type of a layer, so that it matches the manifest it is referenced by.
+type mediaTypeLayer struct {
+	v1.Layer
+	mediaType types.MediaType
+}
+
+func (l mediaTypeLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+func ociLayerMediaType(mediaType types.MediaType) types.MediaType {
+	switch mediaType {
+	case types.DockerLayer:
+		return types.OCILayer
+	case types.DockerUncompressedLayer:
+		return types.OCIUncompressedLayer
+	case types.DockerForeignLayer:
+		return types.OCIRestrictedLayer
+	default:
+		return mediaType
+	}
+}
+
+// appendLdflags adds the given linker flags to the last -ldflags argument in args. As the go command only
+// respects the last -ldflags argument, a new one is only added if none exists yet.
+func appendLdflags(args []string, ldflags string) []string {
+	args = slices.Clone(args)
+	for i := len(args) - 1; i >= 0; i-- {
+		arg := args[i]
+		if strings.HasPrefix(arg, "--") {
+			arg = arg[1:] // flags may be prefixed by one or two dashes
+		}
+		switch {
+		case arg == "-ldflags" && i+1 == len(args):
+			return append(args, ldflags) // value is missing
+		case arg == "-ldflags":
+			args[i+1] = strings.TrimSpace(args[i+1] + " " + ldflags)
+			return args
+		case strings.HasPrefix(arg, "-ldflags="):
+			args[i] = strings.TrimSpace(args[i] + " " + ldflags)
+			return args
+		}
+	}
+	return append(args, "-ldflags", ldflags)
+}
 
-		tag, err := name.NewTag(c.String("tag"))
+// versionLdflags returns -X linker flags that set the configured package variables. Git-derived variables
+// are skipped with a warning if the project is not in a git repository, keeping their default values.
+func versionLdflags(vars ConfigVersionVars, opts binaryOptions) string {
+	var flags []string
+	set := func(variable, value string) {
+		if variable != "" {
+			flags = append(flags, fmt.Sprintf("-X %s=%s", variable, value))
+		}
+	}
+
+	if vars.Version != "" || vars.Commit != "" || vars.Dirty != "" {
+		info, err := opts.git()
 		if err != nil {
-			return fmt.Errorf("failed to create tag: %w", err)
+			slog.Warn("failed to read git info, skipping version variables", "error", err)
+		} else {
+			set(vars.Version, info.Describe)
+			set(vars.Commit, info.Commit)
+			set(vars.Dirty, strconv.FormatBool(info.Dirty))
 		}
-		if err := tarball.WriteToFile(c.String("out"), tag, image); err != nil {
-			return fmt.Errorf("failed to write image to file: %w", err)
+	}
+	set(vars.BuildTime, opts.buildTime.Format(time.RFC3339))
+
+	return strings.Join(flags, " ")
+}
+
+// buildTime returns the creation time of the image. For reproducible builds, it is read from
+// SOURCE_DATE_EPOCH (see https://reproducible-builds.org/specs/source-date-epoch/) and defaults to the
+// unix epoch.
+func buildTime(reproducible bool) (time.Time, error) {
+	if !reproducible {
+		return time.Now().UTC(), nil
+	}
+
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// binaryOptions are build settings that apply to all services.
+type binaryOptions struct {
+	projectRoot  string
+	reproducible bool
+	buildTime    time.Time
+	git          func() (gitInfo, error)
+	cacheDir     string // caching is disabled if empty
+	noCache      bool   // ignore cached binaries, but still update the cache
+}
+
+// goBinary returns the go command to use, which can be overridden by BESPOKE_GO_BIN.
+func goBinary() string {
+	if alt := os.Getenv("BESPOKE_GO_BIN"); alt != "" {
+		return alt
+	}
+	return "go"
+}
+
+// goPlatforms returns all GOOS/GOARCH pairs supported by the go command.
+func goPlatforms(ctx context.Context) ([]v1.Platform, error) {
+	out, err := exec.CommandContext(ctx, goBinary(), "tool", "dist", "list").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list supported platforms: %w", err)
+	}
+	var platforms []v1.Platform
+	for _, line := range strings.Fields(string(out)) {
+		goos, goarch, ok := strings.Cut(line, "/")
+		if !ok {
+			return nil, fmt.Errorf("unexpected platform %q in go tool dist list output", line)
 		}
+		platforms = append(platforms, v1.Platform{OS: goos, Architecture: goarch})
 	}
+	return platforms, nil
+}
 
-	return nil
+// builtBinary is a compiled service binary together with the go command invocation that produced it.
+type builtBinary struct {
+	path string
+	args []string // arguments of the go command, without the output file
+	env  []string // variables set in addition to the environment of bespoke
 }
 
-func buildBinary(ctx context.Context, svc ConfigService, projectRoot string) (file string, err error) {
+// buildBinary compiles the service's package. If platform is set, it overrides the service's GOOS/GOARCH.
+func buildBinary(ctx context.Context, svc ConfigService, platform *v1.Platform, opts binaryOptions) (binary builtBinary, err error) {
 	const (
 		timetzdataTag = "timetzdata"
 	)
@@ -128,7 +897,7 @@ func buildBinary(ctx context.Context, svc ConfigService, projectRoot string) (fi
 	// create temp file and delete on error
 	f, err := os.CreateTemp("", fmt.Sprintf("bespoke-binary-%s-*", svc.Name))
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		return builtBinary{}, fmt.Errorf("failed to create temp file: %w", err)
 	}
 	defer func() {
 		_ = f.Close()
@@ -142,14 +911,13 @@ func buildBinary(ctx context.Context, svc ConfigService, projectRoot string) (fi
 	if svc.Tags != nil {
 		tags = *svc.Tags
 	}
-	if !svc.WithoutTimeTZData && !slices.Contains(tags, timetzdataTag) {
+	if (svc.WithoutTimeTZData == nil || !*svc.WithoutTimeTZData) && !slices.Contains(tags, timetzdataTag) {
 		tags = append(tags, timetzdataTag)
 	}
 
-	// gather final list of arguments
+	// gather final list of arguments, the output file is added when running the command
 	var args = []string{
 		"build",
-		"-o", f.Name(),
 	}
 	if len(tags) != 0 {
 		args = append(args, "-tags", strings.Join(tags, ","))
@@ -157,40 +925,96 @@ func buildBinary(ctx context.Context, svc ConfigService, projectRoot string) (fi
 	if svc.ConfigDefaults.AdditionalFlags != nil {
 		args = append(args, *svc.ConfigDefaults.AdditionalFlags...)
 	}
+	if ldflags := versionLdflags(svc.VersionVars, opts); ldflags != "" {
+		args = appendLdflags(args, ldflags)
+	}
+	if opts.reproducible {
+		// strip local paths and use an empty build id, so that identical sources result in identical binaries
+		args = append(args, "-trimpath")
+		args = appendLdflags(args, "-buildid=")
+	}
 	args = append(args, svc.Package) // has to be last
 
-	// determine which go binary to use
-	goBin := "go"
-	if alt := os.Getenv("BESPOKE_GO_BIN"); alt != "" {
-		goBin = alt
-	}
+	goBin := goBinary()
 
 	// construct environment variables
-	env := os.Environ()
+	var buildEnv []string
+	if platform != nil {
+		svc.GOOS = platform.OS
+		svc.GOARCH = platform.Architecture
+		if platform.Architecture == "arm" && platform.Variant != "" {
+			buildEnv = append(buildEnv, "GOARM="+strings.TrimPrefix(platform.Variant, "v"))
+		}
+	}
 	if svc.GOOS != "" {
-		env = append(env, "GOOS="+svc.GOOS)
+		buildEnv = append(buildEnv, "GOOS="+svc.GOOS)
 	}
 	if svc.GOARCH != "" {
-		env = append(env, "GOARCH="+svc.GOARCH)
+		buildEnv = append(buildEnv, "GOARCH="+svc.GOARCH)
+	}
+	env := append(os.Environ(), buildEnv...)
+	binary = builtBinary{path: f.Name(), args: args, env: buildEnv}
+
+	// reuse the cached binary if none of its inputs changed
+	var cacheFile string
+	if opts.cacheDir != "" && svc.VersionVars.BuildTime != "" && !opts.reproducible {
+		// the build time is part of the key, so the binary could never be reused
+		slog.Debug("not caching binary, as it contains the build time", "service", svc.Name)
+	} else if opts.cacheDir != "" {
+		key, err := binaryCacheKey(ctx, goBin, args, env, opts.projectRoot, opts.git)
+		if err != nil {
+			slog.Warn("failed to compute cache key, building without cache", "service", svc.Name, "error", err)
+		} else {
+			cacheFile = filepath.Join(opts.cacheDir, key)
+		}
+	}
+	if cacheFile != "" && !opts.noCache {
+		ok, err := restoreCachedBinary(cacheFile, f)
+		if err != nil {
+			return builtBinary{}, fmt.Errorf("failed to restore cached binary: %w", err)
+		}
+		if ok {
+			slog.Info("using cached binary", "service", svc.Name, "GOOS", svc.GOOS, "GOARCH", svc.GOARCH)
+			return binary, nil
+		}
+	}
+
+	// prefix output, as multiple builds may run concurrently
+	prefix := svc.Name
+	if platform != nil {
+		prefix += " " + platform.String()
 	}
+	stdout := newPrefixWriter(os.Stdout, prefix)
+	stderr := newPrefixWriter(os.Stderr, prefix)
+	defer stdout.Flush()
+	defer stderr.Flush()
 
 	// build the binary
-	cmd := exec.CommandContext(ctx, goBin, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Dir = projectRoot
+	cmd := exec.CommandContext(ctx, goBin, slices.Concat(args[:1], []string{"-o", f.Name()}, args[1:])...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Dir = opts.projectRoot
 	cmd.Env = env
 
 	slog.Info("building binary", "service", svc.Name, "cmd", cmd.String(), "GOOS", svc.GOOS, "GOARCH", svc.GOARCH)
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to build binary: %w", err)
+		return builtBinary{}, fmt.Errorf("failed to build binary: %w", err)
 	}
 
-	return f.Name(), nil
+	if cacheFile != "" {
+		if err := storeCachedBinary(cacheFile, f.Name()); err != nil {
+			slog.Warn("failed to cache binary", "service", svc.Name, "error", err)
+		}
+	}
+
+	return binary, nil
 }
 
-func addBinariesLayer(image v1.Image, svcNames, binaryPaths []string) (v1.Image, error) {
+// addBinariesLayer adds the binaries as /bin/<name> and makes the first one the entrypoint. If a layer per
+// binary is requested, unchanged binaries keep the same layer digest across builds, which is why those
+// layers use the reproducible build time instead of the image's creation time.
+func addBinariesLayer(image v1.Image, svcNames, binaryPaths []string, opts imageOptions) (v1.Image, error) {
 	var (
 		layerPaths []string
 		layerData  [][]byte
@@ -212,86 +1036,104 @@ func addBinariesLayer(image v1.Image, svcNames, binaryPaths []string) (v1.Image,
 		layerData = append(layerData, binaryData)
 	}
 
-	binaryLayer, err := createTarLayer(layerPaths, layerData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create binary tar layer: %w", err)
+	var binaryLayers []v1.Layer
+	if opts.layerPerBinary {
+		modTime, err := buildTime(true)
+		if err != nil {
+			return nil, err
+		}
+		for i := range layerPaths {
+			layer, err := createTarLayer(layerPaths[i:i+1], layerData[i:i+1], modTime)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create binary tar layer: %w", err)
+			}
+			binaryLayers = append(binaryLayers, layer)
+		}
+	} else {
+		layer, err := createTarLayer(layerPaths, layerData, opts.created)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create binary tar layer: %w", err)
+		}
+		binaryLayers = append(binaryLayers, layer)
 	}
 
-	image, err = mutate.AppendLayers(image, binaryLayer)
+	image, err := mutate.AppendLayers(image, binaryLayers...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to append layers: %w", err)
 	}
 
-	image, err = mutate.Config(image, v1.Config{
-		Entrypoint: []string{layerPaths[0]}, // default to first service
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to set entrypoint: %w", err)
-	}
-
-	return image, nil
-}
-
-func addCACertsLayer(image v1.Image) (v1.Image, error) {
-	caCerts, err := downloadCACerts()
+	// keep the base image's config, but reset its command as it belongs to the base image's entrypoint
+	cf, err := image.ConfigFile()
 	if err != nil {
-		return nil, fmt.Errorf("failed to download CA certificates: %w", err)
+		return nil, fmt.Errorf("failed to get config file: %w", err)
 	}
+	config := *cf.Config.DeepCopy()
+	config.Entrypoint = []string{layerPaths[0]} // default to first service
+	config.Cmd = nil
 
-	caLayer, err := createTarLayer([]string{"/etc/ssl/certs/ca-certificates.crt"}, [][]byte{caCerts})
+	image, err = mutate.Config(image, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create CA certs tar layer: %w", err)
-	}
-
-	image, err = mutate.AppendLayers(image, caLayer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to append layers: %w", err)
+		return nil, fmt.Errorf("failed to set entrypoint: %w", err)
 	}
 
 	return image, nil
 }
 
-func downloadCACerts() ([]byte, error) {
-	resp, err := http.Get("https://curl.se/ca/cacert.pem")
-	if err != nil {
-		return nil, fmt.Errorf("failed to download CA certificates: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to download CA certificates: HTTP %d", resp.StatusCode)
+// createTarLayer creates a layer from the given executable files. All headers are normalized, so that the
+// layer only depends on the given paths, data and modTime.
+func createTarLayer(filePaths []string, data [][]byte, modTime time.Time) (v1.Layer, error) {
+	if len(filePaths) != len(data) {
+		return nil, fmt.Errorf("filePaths and data must have the same length")
 	}
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read CA certificates response: %w", err)
+	entries := make([]tarEntry, len(filePaths))
+	for i, filePath := range filePaths {
+		entries[i] = tarEntry{path: filePath, data: data[i], mode: 0755}
 	}
-
-	return data, nil
+	return createTarLayerFromEntries(entries, modTime)
 }
 
-func createTarLayer(filePaths []string, data [][]byte) (v1.Layer, error) {
-	if len(filePaths) != len(data) {
-		return nil, fmt.Errorf("filePaths and data must have the same length")
-	}
+// tarEntry is a file or, if dir is set, a directory in a tar layer.
+type tarEntry struct {
+	path     string
+	data     []byte
+	mode     int64
+	uid, gid int
+	dir      bool
+}
 
+// createTarLayerFromEntries creates a layer from the given entries in the given order. All headers are
+// normalized, so that the layer only depends on the given entries and modTime.
+func createTarLayerFromEntries(entries []tarEntry, modTime time.Time) (v1.Layer, error) {
 	var buf bytes.Buffer
 	tw := tar.NewWriter(&buf)
 
-	for i, filePath := range filePaths {
-		fileData := data[i]
+	for _, entry := range entries {
 		header := &tar.Header{
-			Name: filePath,
-			Mode: 0755,
-			Size: int64(len(fileData)),
+			Typeflag: tar.TypeReg,
+			Name:     entry.path,
+			Mode:     entry.mode,
+			Uid:      entry.uid,
+			Gid:      entry.gid,
+			Size:     int64(len(entry.data)),
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}
+		if entry.dir {
+			header.Typeflag = tar.TypeDir
+			header.Name = strings.TrimSuffix(entry.path, "/") + "/"
+			header.Size = 0
 		}
 
 		if err := tw.WriteHeader(header); err != nil {
-			return nil, fmt.Errorf("failed to write tar header for %s: %w", filePath, err)
+			return nil, fmt.Errorf("failed to write tar header for %s: %w", entry.path, err)
 		}
 
-		if _, err := tw.Write(fileData); err != nil {
-			return nil, fmt.Errorf("failed to write tar data for %s: %w", filePath, err)
+		if entry.dir {
+			continue
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return nil, fmt.Errorf("failed to write tar data for %s: %w", entry.path, err)
 		}
 	}
 
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// writeTestProject creates a module with a single main package and a config that builds it without a CA
+// bundle, so that no network access is required.
+func writeTestProject(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":          "module example.com/test\n\ngo 1.24\n",
+		"cmd/app/main.go": "package main\n\nfunc main() { println(\"hello\") }\n",
+		"bespoke.toml":    "withoutCABundle = true\n\n[[services]]\nname = \"app\"\npackage = \"./cmd/app\"\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReproducibleBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds binaries with the go command")
+	}
+
+	dir := writeTestProject(t)
+	t.Setenv("GOWORK", "off")
+	t.Setenv("GOFLAGS", "-buildvcs=false")
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	t.Setenv("BESPOKE_CACHE_DIR", t.TempDir())
+
+	build := func(out string) string {
+		t.Helper()
+		args := []string{"bespoke", "-c", filepath.Join(dir, "bespoke.toml"), "build", "--reproducible", "--no-cache", "--out", out}
+		if err := newRootCmd().Run(context.Background(), args); err != nil {
+			t.Fatalf("build failed: %v", err)
+		}
+
+		image, err := tarball.ImageFromPath(out, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := image.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest.String()
+	}
+
+	first := build(filepath.Join(t.TempDir(), "first.tar"))
+	second := build(filepath.Join(t.TempDir(), "second.tar"))
+	if first != second {
+		t.Errorf("digests of repeated builds differ: %s != %s", first, second)
+	}
+}
+
+func TestApplyImageConfigAppend(t *testing.T) {
+	list := func(values ...string) *[]string { return &values }
+
+	service := ConfigImage{
+		Env:          list("...", "A=1"),
+		Cmd:          list("...", "serve"),
+		ExposedPorts: list("...", "8080"),
+		Labels:       list("...", "b=2"),
+	}
+
+	tests := []struct {
+		name       string
+		defaults   ConfigImage
+		wantEnv    []string
+		wantCmd    []string
+		wantPorts  []string
+		wantLabels map[string]string
+	}{
+		{
+			name:       "unset defaults",
+			wantEnv:    []string{"A=1"},
+			wantCmd:    []string{"serve"},
+			wantPorts:  []string{"8080/tcp"},
+			wantLabels: map[string]string{"b": "2"},
+		},
+		{
+			name: "set defaults",
+			defaults: ConfigImage{
+				Env:          list("B=2"),
+				Cmd:          list("--verbose"),
+				ExposedPorts: list("9090/udp"),
+				Labels:       list("a=1"),
+			},
+			wantEnv:    []string{"B=2", "A=1"},
+			wantCmd:    []string{"--verbose", "serve"},
+			wantPorts:  []string{"8080/tcp", "9090/udp"},
+			wantLabels: map[string]string{"a": "1", "b": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, err := applyImageConfig(empty.Image, tt.defaults.merge(service))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cf, err := image.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cf.Config.Env, tt.wantEnv) {
+				t.Errorf("env = %q, want %q", cf.Config.Env, tt.wantEnv)
+			}
+			if !slices.Equal(cf.Config.Cmd, tt.wantCmd) {
+				t.Errorf("cmd = %q, want %q", cf.Config.Cmd, tt.wantCmd)
+			}
+			if ports := slices.Sorted(maps.Keys(cf.Config.ExposedPorts)); !slices.Equal(ports, tt.wantPorts) {
+				t.Errorf("exposed ports = %q, want %q", ports, tt.wantPorts)
+			}
+			if !maps.Equal(cf.Config.Labels, tt.wantLabels) {
+				t.Errorf("labels = %v, want %v", cf.Config.Labels, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func TestBuildServices(t *testing.T) {
+	services := []ConfigService{{Name: "api-a"}, {Name: "api-b"}, {Name: "worker", Default: true}}
+
+	tests := []struct {
+		name       string
+		patterns   []string
+		entrypoint string
+		perService bool
+		want       []string
+		wantErr    string
+	}{
+		{name: "all services", want: []string{"worker", "api-a", "api-b"}},
+		{name: "glob", patterns: []string{"api-*"}, wantErr: "default service worker is not selected"},
+		{name: "glob with entrypoint", patterns: []string{"api-*"}, entrypoint: "api-b", want: []string{"api-b", "api-a"}},
+		{name: "several patterns keep config order", patterns: []string{"worker", "api-a"}, want: []string{"worker", "api-a"}},
+		{name: "overlapping patterns", patterns: []string{"api-?", "*-a"}, entrypoint: "api-a", want: []string{"api-a", "api-b"}},
+		{name: "single service without default", patterns: []string{"api-b"}, want: []string{"api-b"}},
+		{name: "unmatched pattern", patterns: []string{"api-*", "web"}, wantErr: `no service matches "web"`},
+		{name: "invalid pattern", patterns: []string{"["}, wantErr: "invalid service pattern"},
+		{name: "entrypoint not selected", patterns: []string{"api-*"}, entrypoint: "worker", wantErr: "entrypoint worker is not a selected service"},
+		{name: "explicit entrypoint", entrypoint: "api-b", want: []string{"api-b", "api-a", "worker"}},
+		{name: "per service ignores default", patterns: []string{"api-*"}, perService: true, want: []string{"api-a", "api-b"}},
+		{name: "per service rejects entrypoint", entrypoint: "api-a", perService: true, wantErr: "entrypoint cannot be set for per-service images"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildServices(services, tt.patterns, tt.entrypoint, tt.perService)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, svc := range got {
+				names = append(names, svc.Name)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("services = %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildIndexMediaTypes(t *testing.T) {
+	layer, err := createTarLayerFromEntries([]tarEntry{{path: "/bin/app", data: []byte("app"), mode: 0755}}, time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLayer, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDiffID, err := layer.DiffID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := buildIndex([]v1.Image{image}, []*v1.Platform{{OS: "linux", Architecture: "amd64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexManifest.MediaType != types.OCIImageIndex {
+		t.Errorf("index media type = %s, want %s", indexManifest.MediaType, types.OCIImageIndex)
+	}
+
+	for _, desc := range indexManifest.Manifests {
+		if desc.MediaType != types.OCIManifestSchema1 {
+			t.Errorf("manifest media type = %s, want %s", desc.MediaType, types.OCIManifestSchema1)
+		}
+		platformImage, err := index.Image(desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := platformImage.Manifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Config.MediaType != types.OCIConfigJSON {
+			t.Errorf("config media type = %s, want %s", manifest.Config.MediaType, types.OCIConfigJSON)
+		}
+		for _, l := range manifest.Layers {
+			if l.MediaType != types.OCILayer {
+				t.Errorf("layer media type = %s, want %s", l.MediaType, types.OCILayer)
+			}
+			if l.Digest != wantLayer {
+				t.Errorf("layer digest = %s, want %s", l.Digest, wantLayer)
+			}
+		}
+
+		// the layers and config must still match the manifest
+		layers, err := platformImage.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range layers {
+			if mediaType, err := l.MediaType(); err != nil || mediaType != types.OCILayer {
+				t.Errorf("layer reports media type %s (%v), want %s", mediaType, err, types.OCILayer)
+			}
+		}
+		cf, err := platformImage.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cf.RootFS.DiffIDs) != 1 || cf.RootFS.DiffIDs[0] != wantDiffID {
+			t.Errorf("diff ids = %v, want [%s]", cf.RootFS.DiffIDs, wantDiffID)
+		}
+	}
+}
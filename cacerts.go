@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+//go:generate curl -sSfLo cacert.pem https://curl.se/ca/cacert.pem
+
+//go:embed cacert.pem
+var embeddedCACerts []byte
+
+const (
+	caBundleSourceSystem   = "system"
+	caBundleSourceFile     = "file"
+	caBundleSourceEmbedded = "embedded"
+	caBundleSourceURL      = "url"
+
+	defaultCABundleURL = "https://curl.se/ca/cacert.pem"
+
+	caBundlePath = "/etc/ssl/certs/ca-certificates.crt" // path of the CA bundle in the image
+)
+
+// systemCABundlePaths are well-known locations of the system's CA bundle, taken from crypto/x509.
+var systemCABundlePaths = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian/Ubuntu/Gentoo etc.
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora/RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // OpenSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS/RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine Linux, macOS
+}
+
+// createCACertsLayer returns the layer containing the CA bundle and the bundle itself.
+func createCACertsLayer(ctx context.Context, cfg ConfigCABundle, projectRoot string, modTime time.Time) (v1.Layer, []byte, error) {
+	caCerts, err := loadCACerts(ctx, cfg, projectRoot)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CA certificates: %w", err)
+	}
+
+	caLayer, err := createTarLayer([]string{caBundlePath}, [][]byte{caCerts}, modTime)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certs tar layer: %w", err)
+	}
+
+	return caLayer, caCerts, nil
+}
+
+// caBundleDate returns the date of the Mozilla certificate data a CA bundle was generated from, as stated in
+// the header of curl's bundle ("Certificate data from Mozilla as of: ..."). It returns an empty string if
+// the bundle does not contain a date.
+func caBundleDate(data []byte) string {
+	const marker = "Certificate data from Mozilla as of:"
+
+	for line := range strings.Lines(string(data)) {
+		if !strings.HasPrefix(line, "#") {
+			break // the header precedes all certificates
+		}
+		_, date, ok := strings.Cut(line, marker)
+		if !ok {
+			continue
+		}
+		date = strings.TrimSpace(date)
+		if t, err := time.Parse(time.ANSIC+" MST", date); err == nil {
+			return t.UTC().Format(time.DateOnly)
+		}
+		return date
+	}
+	return ""
+}
+
+func loadCACerts(ctx context.Context, cfg ConfigCABundle, projectRoot string) ([]byte, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	switch cfg.Source {
+	case "":
+		data, err = downloadCACerts(ctx, defaultCABundleURL)
+
+	case caBundleSourceSystem:
+		data, err = readSystemCACerts()
+
+	case caBundleSourceFile:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("path is required for CA bundle source %s", cfg.Source)
+		}
+		path := cfg.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(projectRoot, path)
+		}
+		data, err = os.ReadFile(path)
+
+	case caBundleSourceEmbedded:
+		data = embeddedCACerts
+
+	case caBundleSourceURL:
+		if cfg.URL == "" || cfg.SHA256 == "" {
+			return nil, fmt.Errorf("url and sha256 are required for CA bundle source %s", cfg.Source)
+		}
+		data, err = loadPinnedCACerts(ctx, cfg.URL, cfg.SHA256)
+
+	default:
+		return nil, fmt.Errorf("unknown CA bundle source %q", cfg.Source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Contains(data, []byte("-----BEGIN CERTIFICATE-----")) {
+		return nil, fmt.Errorf("CA bundle from source %q does not contain any PEM certificates", cfg.Source)
+	}
+
+	return data, nil
+}
+
+func readSystemCACerts() ([]byte, error) {
+	paths := systemCABundlePaths
+	if file := os.Getenv("SSL_CERT_FILE"); file != "" {
+		paths = []string{file}
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read system CA bundle: %w", err)
+		}
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("no system CA bundle found in %s", strings.Join(paths, ", "))
+}
+
+// loadPinnedCACerts returns the CA bundle from the local cache or downloads it, if it is not cached yet. The
+// bundle is only returned if it matches the given checksum.
+func loadPinnedCACerts(ctx context.Context, url, checksum string) ([]byte, error) {
+	checksum = strings.ToLower(strings.TrimPrefix(checksum, "sha256:"))
+
+	var cachePath string
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		cachePath = filepath.Join(cacheDir, "bespoke", "ca-bundles", checksum+".pem")
+	}
+
+	if cachePath != "" {
+		data, err := os.ReadFile(cachePath)
+		if err == nil && sha256Hex(data) == checksum {
+			slog.Debug("using cached CA bundle", "path", cachePath)
+			return data, nil
+		}
+	}
+
+	data, err := downloadCACerts(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if actual := sha256Hex(data); actual != checksum {
+		return nil, fmt.Errorf("checksum mismatch for CA bundle %s: expected %s, got %s", url, checksum, actual)
+	}
+
+	if cachePath != "" {
+		if err := writeFileAtomic(cachePath, data); err != nil {
+			slog.Warn("failed to cache CA bundle", "path", cachePath, "error", err)
+		}
+	}
+
+	return data, nil
+}
+
+func downloadCACerts(ctx context.Context, url string) ([]byte, error) {
+	slog.Info("downloading CA certificates", "url", url)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download CA certificates: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download CA certificates: HTTP %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificates response: %w", err)
+	}
+
+	return data, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it, so that concurrent readers
+// never observe partially written files.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// goEnvIgnoredForCache are go env variables that do not influence the built binary, but differ between
+// machines or invocations.
+var goEnvIgnoredForCache = []string{"GOCACHE", "GOENV", "GOGCCFLAGS", "GOMODCACHE", "GOPATH", "GOTMPDIR", "GOTELEMETRYDIR"}
+
+// binaryCacheMaxAge is how long cached binaries are kept after they were last used.
+const binaryCacheMaxAge = 7 * 24 * time.Hour
+
+// binaryCacheDir returns the directory in which built binaries are cached, which can be overridden by
+// BESPOKE_CACHE_DIR.
+func binaryCacheDir() (string, error) {
+	if dir := os.Getenv("BESPOKE_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bespoke", "binaries"), nil
+}
+
+// goListPackage is the subset of go list -json output that is relevant for cache keys.
+type goListPackage struct {
+	ImportPath string
+	Dir        string
+	Standard   bool
+	Module     *struct {
+		Path    string
+		Version string
+		Main    bool
+		GoMod   string
+		Replace *struct {
+			Path    string
+			Version string
+		}
+	}
+
+	GoFiles, CgoFiles, CFiles, CXXFiles, MFiles, HFiles, FFiles, SFiles, SwigFiles, SwigCXXFiles, SysoFiles, EmbedFiles []string
+}
+
+// binaryCacheKey hashes everything that determines the binary built by "go <args>": the arguments, the go
+// environment including the Go version, the versions of all dependency modules and the contents of all
+// source files of local packages in the dependency closure. Standard library packages are covered by the
+// Go version. Unless VCS stamping is disabled with -buildvcs=false, the commit and dirty state that go build
+// stamps into binaries are part of the key as well.
+func binaryCacheKey(ctx context.Context, goBin string, args, env []string, dir string, git func() (gitInfo, error)) (string, error) {
+	if len(args) < 2 || args[0] != "build" {
+		panic("args must be a go build command line ending with the package")
+	}
+
+	run := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, goBin, args...)
+		cmd.Dir = dir
+		cmd.Env = env
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run go %s: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return out, nil
+	}
+
+	h := sha256.New()
+	write := func(parts ...string) {
+		for _, part := range parts {
+			_, _ = io.WriteString(h, part)
+			_, _ = h.Write([]byte{0})
+		}
+	}
+
+	write(args...)
+
+	// go environment
+	rawEnv, err := run("env", "-json")
+	if err != nil {
+		return "", err
+	}
+	var goEnv map[string]string
+	if err := json.Unmarshal(rawEnv, &goEnv); err != nil {
+		return "", fmt.Errorf("failed to parse go env: %w", err)
+	}
+	for _, key := range slices.Sorted(maps.Keys(goEnv)) {
+		if !slices.Contains(goEnvIgnoredForCache, key) {
+			write(key, goEnv[key])
+		}
+	}
+
+	// VCS information, which go build only stamps if the project is in a repository
+	if !buildVCSDisabled(slices.Concat(args, strings.Fields(goEnv["GOFLAGS"]))) {
+		if info, err := git(); err == nil {
+			write("vcs", info.Commit, strconv.FormatBool(info.Dirty))
+		}
+	}
+
+	// dependency closure, using the same build flags as go build
+	rawList, err := run(slices.Concat([]string{"list", "-deps", "-json"}, args[1:])...)
+	if err != nil {
+		return "", err
+	}
+	hashedGoMods := make(map[string]bool)
+	dec := json.NewDecoder(bytes.NewReader(rawList))
+	for {
+		var pkg goListPackage
+		if err := dec.Decode(&pkg); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("failed to parse go list output: %w", err)
+		}
+
+		write("package", pkg.ImportPath)
+		if pkg.Standard {
+			continue
+		}
+
+		// modules from the module cache are immutable, so their version is sufficient
+		if mod := pkg.Module; mod != nil && !mod.Main {
+			if mod.Replace == nil {
+				write(mod.Path, mod.Version)
+				continue
+			}
+			if mod.Replace.Version != "" {
+				write(mod.Path, mod.Replace.Path, mod.Replace.Version)
+				continue
+			}
+		}
+
+		// local packages are hashed by content
+		if mod := pkg.Module; mod != nil && mod.GoMod != "" && !hashedGoMods[mod.GoMod] {
+			hashedGoMods[mod.GoMod] = true
+			for _, file := range []string{mod.GoMod, filepath.Join(filepath.Dir(mod.GoMod), "go.sum")} {
+				if err := hashFile(h, file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return "", err
+				}
+			}
+		}
+		files := slices.Concat(pkg.GoFiles, pkg.CgoFiles, pkg.CFiles, pkg.CXXFiles, pkg.MFiles, pkg.HFiles, pkg.FFiles,
+			pkg.SFiles, pkg.SwigFiles, pkg.SwigCXXFiles, pkg.SysoFiles, pkg.EmbedFiles)
+		for _, file := range files {
+			write(file)
+			if err := hashFile(h, filepath.Join(pkg.Dir, file)); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildVCSDisabled reports whether the go build flags disable stamping VCS information into binaries.
+func buildVCSDisabled(flags []string) bool {
+	disabled := false
+	for _, flag := range flags {
+		if !strings.HasPrefix(flag, "-") {
+			continue
+		}
+		// flags can be given with one or two dashes
+		switch name, value, _ := strings.Cut(strings.TrimLeft(flag, "-"), "="); {
+		case name != "buildvcs":
+		case value == "":
+			disabled = false
+		default:
+			disabled = value == "false"
+		}
+	}
+	return disabled
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return nil
+}
+
+// restoreCachedBinary copies the cached binary into dst. It returns false if the binary is not cached.
+func restoreCachedBinary(cacheFile string, dst io.Writer) (bool, error) {
+	f, err := os.Open(cacheFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(dst, f); err != nil {
+		return false, fmt.Errorf("failed to copy cached binary: %w", err)
+	}
+
+	// mark the binary as used, so that it is not pruned
+	now := time.Now()
+	_ = os.Chtimes(cacheFile, now, now)
+	return true, nil
+}
+
+// storeCachedBinary copies the binary into the cache. The file is renamed into place, so that concurrent
+// builds never observe partially written binaries.
+func storeCachedBinary(cacheFile, binary string) error {
+	data, err := os.ReadFile(binary)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cacheFile, data)
+}
+
+// pruneBinaryCache removes cached binaries that have not been used for longer than maxAge. Only files named
+// like cache keys are removed, as the cache directory can be chosen freely.
+func pruneBinaryCache(dir string, maxAge time.Duration, now time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isCacheKey(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed concurrently
+		}
+		if now.Sub(info.ModTime()) <= maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isCacheKey reports whether name is a key as returned by binaryCacheKey.
+func isCacheKey(name string) bool {
+	b, err := hex.DecodeString(name)
+	return err == nil && len(b) == sha256.Size
+}
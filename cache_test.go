@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuildVCSDisabled(t *testing.T) {
+	tests := []struct {
+		flags []string
+		want  bool
+	}{
+		{flags: nil, want: false},
+		{flags: []string{"build", "-trimpath", "./cmd/app"}, want: false},
+		{flags: []string{"build", "-buildvcs=false", "./cmd/app"}, want: true},
+		{flags: []string{"build", "--buildvcs=false", "./cmd/app"}, want: true},
+		{flags: []string{"build", "-buildvcs=auto"}, want: false},
+		{flags: []string{"-buildvcs=false", "build", "-buildvcs"}, want: false}, // last flag wins
+		{flags: []string{"build", "-buildvcs=true", "-buildvcs=false"}, want: true},
+	}
+	for _, tt := range tests {
+		if got := buildVCSDisabled(tt.flags); got != tt.want {
+			t.Errorf("buildVCSDisabled(%q) = %v, want %v", tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestBinaryCacheKeyVCS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the go and git commands")
+	}
+
+	dir := writeTestProject(t)
+	t.Setenv("GOWORK", "off")
+	t.Setenv("GOFLAGS", "")
+
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "initial")
+
+	ctx := context.Background()
+	key := func(args ...string) string {
+		t.Helper()
+		info := sync.OnceValues(func() (gitInfo, error) { return readGitInfo(ctx, dir) })
+		k, err := binaryCacheKey(ctx, goBinary(), append([]string{"build"}, append(args, "./cmd/app")...), os.Environ(), dir, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	clean := key()
+	cleanNoVCS := key("-buildvcs=false")
+
+	// a commit without changes to Go files changes the stamped revision
+	git("commit", "-q", "--allow-empty", "-m", "empty")
+	if key() == clean {
+		t.Error("key did not change after a commit")
+	}
+	if key("-buildvcs=false") != cleanNoVCS {
+		t.Error("key changed after a commit although VCS stamping is disabled")
+	}
+	committed := key()
+
+	// an uncommitted file that is not part of the build changes the stamped modified flag
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("dirty"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if key() == committed {
+		t.Error("key did not change for a dirty worktree")
+	}
+}
+
+func TestPruneBinaryCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	files := []struct {
+		name     string
+		age      time.Duration
+		wantKept bool
+	}{
+		{name: strings.Repeat("a", 64), age: time.Hour, wantKept: true},
+		{name: strings.Repeat("b", 64), age: 2 * binaryCacheMaxAge, wantKept: false},
+		{name: "notes.txt", age: 2 * binaryCacheMaxAge, wantKept: true}, // not a cache key
+		{name: strings.Repeat("c", 63), age: 2 * binaryCacheMaxAge, wantKept: true},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte("binary"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-f.age), now.Add(-f.age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// restoring an old binary marks it as used
+	used := filepath.Join(dir, strings.Repeat("d", 64))
+	if err := os.WriteFile(used, []byte("binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(used, now.Add(-2*binaryCacheMaxAge), now.Add(-2*binaryCacheMaxAge)); err != nil {
+		t.Fatal(err)
+	}
+	var dst strings.Builder
+	if ok, err := restoreCachedBinary(used, &dst); err != nil || !ok {
+		t.Fatalf("restoreCachedBinary() = %v, %v", ok, err)
+	}
+
+	if err := pruneBinaryCache(dir, binaryCacheMaxAge, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f.name))
+		if kept := err == nil; kept != f.wantKept {
+			t.Errorf("%s: kept = %v, want %v", f.name, kept, f.wantKept)
+		}
+	}
+	if _, err := os.Stat(used); err != nil {
+		t.Errorf("recently used binary was pruned: %v", err)
+	}
+
+	if err := pruneBinaryCache(filepath.Join(dir, "missing"), binaryCacheMaxAge, now); err != nil {
+		t.Errorf("pruning a missing cache failed: %v", err)
+	}
+}
+
+func TestAppendLdflags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{args: []string{"build"}, want: []string{"build", "-ldflags", "-X a=b"}},
+		{args: []string{"build", "-ldflags", "-s -w"}, want: []string{"build", "-ldflags", "-s -w -X a=b"}},
+		{args: []string{"build", "-ldflags=-s -w"}, want: []string{"build", "-ldflags=-s -w -X a=b"}},
+		{args: []string{"build", "--ldflags", "-s"}, want: []string{"build", "--ldflags", "-s -X a=b"}},
+		{args: []string{"build", "--ldflags=-s"}, want: []string{"build", "--ldflags=-s -X a=b"}},
+		{args: []string{"build", "-ldflags", ""}, want: []string{"build", "-ldflags", "-X a=b"}},
+		// only the last -ldflags is used by the go command
+		{args: []string{"build", "-ldflags=-s", "-trimpath", "-ldflags", "-w"}, want: []string{"build", "-ldflags=-s", "-trimpath", "-ldflags", "-w -X a=b"}},
+		{args: []string{"build", "-ldflags", "-w", "--ldflags=-s"}, want: []string{"build", "-ldflags", "-w", "--ldflags=-s -X a=b"}},
+		{args: []string{"build", "-trimpath", "-ldflags"}, want: []string{"build", "-trimpath", "-ldflags", "-X a=b"}},
+		{args: []string{"build", "-gcflags=-N"}, want: []string{"build", "-gcflags=-N", "-ldflags", "-X a=b"}},
+	}
+	for _, tt := range tests {
+		args := slices.Clone(tt.args)
+		if got := appendLdflags(tt.args, "-X a=b"); !slices.Equal(got, tt.want) {
+			t.Errorf("appendLdflags(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+		if !slices.Equal(tt.args, args) {
+			t.Errorf("appendLdflags(%q) modified its argument", args)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"cmp"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -17,24 +18,120 @@ const (
 type Config struct {
 	ProjectRoot string `toml:"-"`
 
-	WithoutCABundle bool `toml:"withoutCABundle"`
+	path string     // file the config was loaded from
+	raw  []byte     // contents of the config file
+	keys []toml.Key // all keys defined in the config file
 
-	Defaults ConfigDefaults  `toml:"defaults"`
-	Services []ConfigService `toml:"services"`
+	WithoutCABundle  bool     `toml:"withoutCABundle,omitempty"`
+	PerServiceImages bool     `toml:"perServiceImages,omitempty"`
+	Reproducible     bool     `toml:"reproducible,omitempty"`
+	BinaryLayers     string   `toml:"binaryLayers,omitempty"` // single (default) or perService
+	Jobs             int      `toml:"jobs,omitzero"`
+	SBOM             []string `toml:"sbom,omitempty"`       // spdx and/or cyclonedx
+	Provenance       bool     `toml:"provenance,omitempty"` // record SLSA provenance
+
+	CABundle ConfigCABundle           `toml:"caBundle,omitempty"`
+	Defaults ConfigDefaults           `toml:"defaults,omitempty"`
+	Profiles map[string]ConfigProfile `toml:"profiles,omitempty"`
+	Services []ConfigService          `toml:"services,omitempty"`
+
+	profile string // name of the selected profile, if any
+}
+
+type ConfigCABundle struct {
+	Source string `toml:"source,omitempty"` // system, file, embedded or url (default: unpinned download from curl.se)
+	Path   string `toml:"path,omitempty"`   // PEM file relative to the project root, for source file
+	URL    string `toml:"url,omitempty"`    // for source url
+	SHA256 string `toml:"sha256,omitempty"` // checksum of the downloaded bundle, required for source url
 }
 
 type ConfigDefaults struct {
-	GOOS              string    `toml:"GOOS"`
-	GOARCH            string    `toml:"GOARCH"`
-	Tags              *[]string `toml:"tags"`
-	AdditionalFlags   *[]string `toml:"additionalFlags"`
-	WithoutTimeTZData bool      `toml:"withoutTimeTZData"`
+	GOOS              string            `toml:"GOOS,omitempty"`
+	GOARCH            string            `toml:"GOARCH,omitempty"`
+	Platforms         *[]string         `toml:"platforms,omitempty"` // e.g. linux/amd64, takes precedence over GOOS/GOARCH
+	Tags              *[]string         `toml:"tags,omitempty"`
+	AdditionalFlags   *[]string         `toml:"additionalFlags,omitempty"`
+	WithoutTimeTZData *bool             `toml:"withoutTimeTZData,omitempty"` // pointer, so that later layers can set it to false
+	BaseImage         string            `toml:"baseImage,omitempty"`         // registry reference, tarball:<file> or oci:<dir>
+	Files             *[]ConfigFile     `toml:"files,omitempty"`
+	VersionVars       ConfigVersionVars `toml:"versionVars,omitempty"`
+	Image             ConfigImage       `toml:"image,omitempty"`
+}
+
+// ConfigVersionVars names package variables (e.g. main.version) that are set via -ldflags -X at build time.
+type ConfigVersionVars struct {
+	Version   string `toml:"version,omitempty"`   // git describe --tags --always --dirty
+	Commit    string `toml:"commit,omitempty"`    // full commit hash
+	Dirty     string `toml:"dirty,omitempty"`     // "true" if the worktree has uncommitted changes, "false" otherwise
+	BuildTime string `toml:"buildTime,omitempty"` // RFC 3339 build time, honours reproducible builds
+}
+
+// ConfigFile copies local files into the image. Like string slices, a service's files replace the default
+// files, unless the first entry's src is the append placeholder.
+type ConfigFile struct {
+	Src     string   `toml:"src,omitempty"`     // file, directory or glob relative to the project root
+	Dst     string   `toml:"dst,omitempty"`     // absolute path in the image, treated as directory if it ends with / or src is a glob
+	Mode    int64    `toml:"mode,omitzero"`     // e.g. 0o644, defaults to 0755 for local executables and 0644 otherwise
+	UID     int      `toml:"uid,omitzero"`      // owner of all copied files and directories
+	GID     int      `toml:"gid,omitzero"`      // group of all copied files and directories
+	Exclude []string `toml:"exclude,omitempty"` // additional .bespokeignore patterns
+}
+
+// ConfigImage maps onto the OCI image config. It only applies to the service that is the image's entrypoint.
+type ConfigImage struct {
+	Env          *[]string `toml:"env,omitempty"` // KEY=value
+	Cmd          *[]string `toml:"cmd,omitempty"`
+	WorkingDir   string    `toml:"workingDir,omitempty"`
+	User         string    `toml:"user,omitempty"`
+	UserName     string    `toml:"userName,omitempty"`     // generates /etc/passwd, /etc/group and a home directory
+	GroupName    string    `toml:"groupName,omitempty"`    // defaults to userName
+	UID          *int      `toml:"uid,omitempty"`          // defaults to 65532
+	GID          *int      `toml:"gid,omitempty"`          // defaults to uid
+	ExposedPorts *[]string `toml:"exposedPorts,omitempty"` // e.g. 8080 or 8080/tcp
+	StopSignal   string    `toml:"stopSignal,omitempty"`
+	Labels       *[]string `toml:"labels,omitempty"` // key=value
+}
+
+// ConfigProfile is a named set of settings that is layered over the defaults and services when selected
+// with --profile. The layers are merged in the order defaults, profile, service and the profile's settings
+// for the service, with the same rules as services over defaults: settings of later layers override those
+// of the previous layers, and lists replace or, if they start with the append placeholder, extend them.
+type ConfigProfile struct {
+	ConfigDefaults
+	Services map[string]ConfigDefaults `toml:"services,omitempty"` // by service name
 }
 
 type ConfigService struct {
 	ConfigDefaults
 	Name    string `toml:"name"`
 	Package string `toml:"package"`
+	Default bool   `toml:"default,omitempty"` // entrypoint of the image, defaults to the first service
+}
+
+var configCmd = &cli.Command{
+	Name:  "config",
+	Usage: "print the config with the defaults and the selected profile applied to every service",
+	Action: func(ctx context.Context, c *cli.Command) error {
+		cfg, err := loadConfig(c)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+
+		resolved := cfg
+		resolved.Defaults = ConfigDefaults{}
+		resolved.Profiles = nil
+		resolved.Services = cfg.mergedServices()
+
+		if cfg.profile != "" {
+			fmt.Printf("# profile: %s\n", cfg.profile)
+		}
+		enc := toml.NewEncoder(os.Stdout)
+		enc.Indent = ""
+		if err := enc.Encode(resolved); err != nil {
+			return fmt.Errorf("failed to encode config: %w", err)
+		}
+		return nil
+	},
 }
 
 func loadConfig(c *cli.Command) (Config, error) {
@@ -46,11 +143,26 @@ func loadConfig(c *cli.Command) (Config, error) {
 	}
 
 	var config Config
-	if err := toml.Unmarshal(raw, &config); err != nil {
+	md, err := toml.Decode(string(raw), &config)
+	if err != nil {
 		return Config{}, fmt.Errorf("failed to unmarshal config file: %w", err)
 	}
 
 	config.ProjectRoot = filepath.Dir(path)
+	config.path = path
+	config.raw = raw
+	config.keys = md.Keys()
+
+	if profile := c.String("profile"); profile != "" {
+		if _, ok := config.Profiles[profile]; !ok {
+			return Config{}, fmt.Errorf("profile %s is not defined in config file", profile)
+		}
+		config.profile = profile
+	}
+
+	if err := interpolateConfig(&config, os.LookupEnv); err != nil {
+		return Config{}, fmt.Errorf("failed to expand environment variables:\n%w", err)
+	}
 
 	serviceNameSet := make(map[string]struct{})
 	for _, service := range config.Services {
@@ -63,13 +175,58 @@ func loadConfig(c *cli.Command) (Config, error) {
 	return config, nil
 }
 
+// mergedServices returns all services with the defaults and the selected profile applied.
+func (c Config) mergedServices() []ConfigService {
+	profile := c.Profiles[c.profile]
+
+	services := make([]ConfigService, len(c.Services))
+	for i, service := range c.Services {
+		service.ConfigDefaults = c.Defaults.
+			merge(profile.ConfigDefaults).
+			merge(service.ConfigDefaults).
+			merge(profile.Services[service.Name])
+		services[i] = service
+	}
+	return services
+}
+
 func (c ConfigDefaults) merge(other ConfigDefaults) ConfigDefaults {
 	return ConfigDefaults{
-		GOOS:              cmp.Or(c.GOOS, other.GOOS),
-		GOARCH:            cmp.Or(c.GOARCH, other.GOARCH),
+		GOOS:              cmp.Or(other.GOOS, c.GOOS),
+		GOARCH:            cmp.Or(other.GOARCH, c.GOARCH),
+		Platforms:         mergeStringSlice(c.Platforms, other.Platforms),
 		Tags:              mergeStringSlice(c.Tags, other.Tags),
 		AdditionalFlags:   mergeStringSlice(c.AdditionalFlags, other.AdditionalFlags),
-		WithoutTimeTZData: cmp.Or(c.WithoutTimeTZData, other.WithoutTimeTZData),
+		WithoutTimeTZData: cmp.Or(other.WithoutTimeTZData, c.WithoutTimeTZData),
+		BaseImage:         cmp.Or(other.BaseImage, c.BaseImage),
+		Files:             mergeFiles(c.Files, other.Files),
+		VersionVars:       c.VersionVars.merge(other.VersionVars),
+		Image:             c.Image.merge(other.Image),
+	}
+}
+
+func (c ConfigVersionVars) merge(other ConfigVersionVars) ConfigVersionVars {
+	return ConfigVersionVars{
+		Version:   cmp.Or(other.Version, c.Version),
+		Commit:    cmp.Or(other.Commit, c.Commit),
+		Dirty:     cmp.Or(other.Dirty, c.Dirty),
+		BuildTime: cmp.Or(other.BuildTime, c.BuildTime),
+	}
+}
+
+func (c ConfigImage) merge(other ConfigImage) ConfigImage {
+	return ConfigImage{
+		Env:          mergeStringSlice(c.Env, other.Env),
+		Cmd:          mergeStringSlice(c.Cmd, other.Cmd),
+		WorkingDir:   cmp.Or(other.WorkingDir, c.WorkingDir),
+		User:         cmp.Or(other.User, c.User),
+		UserName:     cmp.Or(other.UserName, c.UserName),
+		GroupName:    cmp.Or(other.GroupName, c.GroupName),
+		UID:          cmp.Or(other.UID, c.UID),
+		GID:          cmp.Or(other.GID, c.GID),
+		ExposedPorts: mergeStringSlice(c.ExposedPorts, other.ExposedPorts),
+		StopSignal:   cmp.Or(other.StopSignal, c.StopSignal),
+		Labels:       mergeStringSlice(c.Labels, other.Labels),
 	}
 }
 
@@ -80,8 +237,30 @@ func mergeStringSlice(a, b *[]string) *[]string {
 	if len(*b) == 0 {
 		return nil
 	}
-	if a != nil && (*b)[0] == arrayAppendPlaceholder {
-		merged := append(*a, (*b)[1:]...)
+	if (*b)[0] == arrayAppendPlaceholder {
+		var merged []string
+		if a != nil {
+			merged = append(merged, *a...) // copy, as a may be shared by several layers
+		}
+		merged = append(merged, (*b)[1:]...)
+		return &merged
+	}
+	return b
+}
+
+func mergeFiles(a, b *[]ConfigFile) *[]ConfigFile {
+	if b == nil {
+		return a
+	}
+	if len(*b) == 0 {
+		return nil
+	}
+	if (*b)[0].Src == arrayAppendPlaceholder {
+		var merged []ConfigFile
+		if a != nil {
+			merged = append(merged, *a...)
+		}
+		merged = append(merged, (*b)[1:]...)
 		return &merged
 	}
 	return b
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestMergedServices(t *testing.T) {
+	const raw = `
+[defaults]
+GOOS = "linux"
+GOARCH = "amd64"
+baseImage = "base"
+additionalFlags = ["-trimpath"]
+withoutTimeTZData = true
+image.workingDir = "/"
+
+[profiles.prod]
+GOARCH = "arm64"
+baseImage = "prod-base"
+additionalFlags = ["...", "-ldflags=-s -w"]
+tags = ["...", "netgo"]
+image.workingDir = "/srv"
+
+[profiles.prod.services.b]
+GOOS = "darwin"
+withoutTimeTZData = false
+image.workingDir = "/b-prod"
+
+[[services]]
+name = "a"
+package = "./cmd/a"
+
+[[services]]
+name = "b"
+package = "./cmd/b"
+GOOS = "windows"
+baseImage = "b-base"
+tags = ["...", "b"]
+image.workingDir = "/b"
+`
+
+	tests := []struct {
+		profile        string
+		service        int
+		wantGOOS       string
+		wantGOARCH     string
+		wantBaseImage  string
+		wantFlags      []string
+		wantTags       []string
+		wantWorkingDir string
+	}{
+		{service: 0, wantGOOS: "linux", wantGOARCH: "amd64", wantBaseImage: "base", wantFlags: []string{"-trimpath"}, wantWorkingDir: "/"},
+		{service: 1, wantGOOS: "windows", wantGOARCH: "amd64", wantBaseImage: "b-base", wantFlags: []string{"-trimpath"}, wantTags: []string{"b"}, wantWorkingDir: "/b"},
+		{profile: "prod", service: 0, wantGOOS: "linux", wantGOARCH: "arm64", wantBaseImage: "prod-base", wantFlags: []string{"-trimpath", "-ldflags=-s -w"}, wantTags: []string{"netgo"}, wantWorkingDir: "/srv"},
+		{profile: "prod", service: 1, wantGOOS: "darwin", wantGOARCH: "arm64", wantBaseImage: "b-base", wantFlags: []string{"-trimpath", "-ldflags=-s -w"}, wantTags: []string{"netgo", "b"}, wantWorkingDir: "/b-prod"},
+	}
+	for _, tt := range tests {
+		var cfg Config
+		if _, err := toml.Decode(raw, &cfg); err != nil {
+			t.Fatal(err)
+		}
+		cfg.profile = tt.profile
+
+		svc := cfg.mergedServices()[tt.service]
+		if svc.GOOS != tt.wantGOOS {
+			t.Errorf("profile %q, service %s: GOOS = %q, want %q", tt.profile, svc.Name, svc.GOOS, tt.wantGOOS)
+		}
+		if svc.GOARCH != tt.wantGOARCH {
+			t.Errorf("profile %q, service %s: GOARCH = %q, want %q", tt.profile, svc.Name, svc.GOARCH, tt.wantGOARCH)
+		}
+		if svc.BaseImage != tt.wantBaseImage {
+			t.Errorf("profile %q, service %s: baseImage = %q, want %q", tt.profile, svc.Name, svc.BaseImage, tt.wantBaseImage)
+		}
+		if svc.AdditionalFlags == nil || !slices.Equal(*svc.AdditionalFlags, tt.wantFlags) {
+			t.Errorf("profile %q, service %s: additionalFlags = %v, want %q", tt.profile, svc.Name, svc.AdditionalFlags, tt.wantFlags)
+		}
+		// appending to a list that is not set in a lower layer must not leak the placeholder
+		var tags []string
+		if svc.Tags != nil {
+			tags = *svc.Tags
+		}
+		if !slices.Equal(tags, tt.wantTags) {
+			t.Errorf("profile %q, service %s: tags = %q, want %q", tt.profile, svc.Name, tags, tt.wantTags)
+		}
+		// only the profile's settings for b switch it off again
+		wantWithoutTimeTZData := tt.profile != "prod" || tt.service != 1
+		if svc.WithoutTimeTZData == nil || *svc.WithoutTimeTZData != wantWithoutTimeTZData {
+			t.Errorf("profile %q, service %s: withoutTimeTZData = %v, want %v", tt.profile, svc.Name, svc.WithoutTimeTZData, wantWithoutTimeTZData)
+		}
+		if svc.Image.WorkingDir != tt.wantWorkingDir {
+			t.Errorf("profile %q, service %s: image.workingDir = %q, want %q", tt.profile, svc.Name, svc.Image.WorkingDir, tt.wantWorkingDir)
+		}
+	}
+}
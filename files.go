@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// createFilesLayer creates a layer with the configured files of all given services. It returns nil if no
+// files are configured. Files that are configured for multiple services, e.g. via the defaults, are only
+// added once, but different files must not map to the same destination.
+func createFilesLayer(services []ConfigService, projectRoot string, modTime time.Time) (v1.Layer, error) {
+	ignore, err := loadIgnoreFile(filepath.Join(projectRoot, ignoreFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]tarEntry)
+	for _, service := range services {
+		if service.Files == nil {
+			continue
+		}
+		for _, file := range *service.Files {
+			collected, err := collectFiles(file, projectRoot, ignore)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: failed to collect files for %s: %w", service.Name, file.Src, err)
+			}
+			for _, entry := range collected {
+				if existing, ok := entries[entry.path]; ok && !sameTarEntry(existing, entry) {
+					return nil, fmt.Errorf("service %s: conflicting files for destination %s", service.Name, entry.path)
+				}
+				entries[entry.path] = entry
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	// add missing parent directories, as some runtimes do not create them implicitly
+	for p := range entries {
+		for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+			if _, ok := entries[dir]; !ok {
+				entries[dir] = tarEntry{path: dir, mode: 0755, dir: true}
+			}
+		}
+	}
+
+	paths := slices.Sorted(maps.Keys(entries))
+	sorted := make([]tarEntry, len(paths))
+	for i, p := range paths {
+		sorted[i] = entries[p]
+	}
+
+	return createTarLayerFromEntries(sorted, modTime)
+}
+
+// collectFiles resolves the file config into tar entries. Globs and destinations ending in / copy every
+// match into the destination directory, directories are copied recursively.
+func collectFiles(file ConfigFile, projectRoot string, ignore ignorePatterns) ([]tarEntry, error) {
+	if file.Src == "" || file.Dst == "" {
+		return nil, fmt.Errorf("src and dst are required")
+	}
+	if !path.IsAbs(file.Dst) {
+		return nil, fmt.Errorf("dst %s must be an absolute path", file.Dst)
+	}
+
+	exclude, err := parseIgnorePatterns(file.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse exclude patterns: %w", err)
+	}
+	ignore = append(slices.Clip(ignore), exclude...)
+
+	src := filepath.Join(projectRoot, filepath.FromSlash(file.Src))
+	isGlob := strings.ContainsAny(file.Src, "*?[")
+
+	matches := []string{src}
+	if isGlob {
+		matches, err = filepath.Glob(src)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob: %w", err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match")
+		}
+	}
+
+	var entries []tarEntry
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(projectRoot, match)
+		if err != nil {
+			return nil, err
+		}
+		if ignore.ignored(filepath.ToSlash(rel), info.IsDir()) {
+			continue
+		}
+
+		dst := path.Clean(file.Dst)
+		if isGlob || strings.HasSuffix(file.Dst, "/") {
+			dst = path.Join(dst, filepath.Base(match))
+		}
+
+		if !info.IsDir() {
+			entry, err := fileTarEntry(match, info, dst, file)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+			continue
+		}
+
+		err = filepath.WalkDir(match, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(projectRoot, p)
+			if err != nil {
+				return err
+			}
+			info, err := os.Stat(p) // follow symlinks
+			if err != nil {
+				return err
+			}
+			if p != match && ignore.ignored(filepath.ToSlash(rel), info.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			relToMatch, err := filepath.Rel(match, p)
+			if err != nil {
+				return err
+			}
+			entryDst := path.Join(dst, filepath.ToSlash(relToMatch))
+
+			if info.IsDir() {
+				if !d.IsDir() {
+					return fmt.Errorf("symlinked directory %s is not supported", p)
+				}
+				entries = append(entries, tarEntry{path: entryDst, mode: 0755, uid: file.UID, gid: file.GID, dir: true})
+				return nil
+			}
+
+			entry, err := fileTarEntry(p, info, entryDst, file)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+func fileTarEntry(src string, info fs.FileInfo, dst string, file ConfigFile) (tarEntry, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return tarEntry{}, err
+	}
+
+	mode := file.Mode
+	if mode == 0 {
+		mode = 0644
+		if info.Mode()&0111 != 0 {
+			mode = 0755
+		}
+	}
+
+	return tarEntry{path: dst, data: data, mode: mode, uid: file.UID, gid: file.GID}, nil
+}
+
+func sameTarEntry(a, b tarEntry) bool {
+	return a.path == b.path && a.mode == b.mode && a.uid == b.uid && a.gid == b.gid && a.dir == b.dir &&
+		string(a.data) == string(b.data)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// gitInfo describes the state of the git repository containing the project.
+type gitInfo struct {
+	Commit   string
+	ShortSHA string
+	Branch   string // empty for a detached HEAD
+	Describe string
+	Dirty    bool
+}
+
+func readGitInfo(ctx context.Context, dir string) (gitInfo, error) {
+	run := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run git %s: %w", strings.Join(args, " "), err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	var (
+		info gitInfo
+		err  error
+	)
+	if info.Commit, err = run("rev-parse", "HEAD"); err != nil {
+		return gitInfo{}, err
+	}
+	if info.ShortSHA, err = run("rev-parse", "--short", "HEAD"); err != nil {
+		return gitInfo{}, err
+	}
+	if info.Branch, err = run("rev-parse", "--abbrev-ref", "HEAD"); err != nil {
+		return gitInfo{}, err
+	}
+	if info.Branch == "HEAD" {
+		info.Branch = ""
+	}
+	if info.Describe, err = run("describe", "--tags", "--always", "--dirty"); err != nil {
+		return gitInfo{}, err
+	}
+	status, err := run("status", "--porcelain")
+	if err != nil {
+		return gitInfo{}, err
+	}
+	info.Dirty = status != ""
+
+	return info, nil
+}
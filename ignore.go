@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	ignoreFileName = ".bespokeignore"
+)
+
+// ignorePattern is a single gitignore-style pattern.
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignorePatterns excludes paths relative to the project root, following the rules of .gitignore files:
+// patterns without a slash match at any depth, a leading ! negates a pattern, a trailing slash only
+// matches directories and ** matches any number of directories. The last matching pattern wins.
+type ignorePatterns []ignorePattern
+
+func loadIgnoreFile(file string) (ignorePatterns, error) {
+	raw, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+	patterns, err := parseIgnorePatterns(strings.Split(string(raw), "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ignore file %s: %w", file, err)
+	}
+	return patterns, nil
+}
+
+func parseIgnorePatterns(lines []string) (ignorePatterns, error) {
+	var patterns ignorePatterns
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		anchored := strings.Contains(line, "/")
+		expr := globToRegexp(strings.TrimPrefix(line, "/"))
+		if !anchored {
+			expr = "(.*/)?" + expr
+		}
+
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", line, err)
+		}
+		p.re = re
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			b.WriteString(regexp.QuoteMeta(string(glob[i+1])))
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// ignored reports whether the slash-separated path relative to the project root, or any of its parent
+// directories, is excluded.
+func (p ignorePatterns) ignored(rel string, isDir bool) bool {
+	if len(p) == 0 {
+		return false
+	}
+	for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if p.match(dir, true) {
+			return true
+		}
+	}
+	return p.match(rel, isDir)
+}
+
+func (p ignorePatterns) match(rel string, isDir bool) bool {
+	excluded := false
+	for _, pattern := range p {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.re.MatchString(rel) {
+			excluded = !pattern.negate
+		}
+	}
+	return excluded
+}
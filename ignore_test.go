@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		want string
+	}{
+		{glob: "*.go", want: `[^/]*\.go`},
+		{glob: "a?c", want: `a[^/]c`},
+		{glob: "**/tmp", want: `(.*/)?tmp`},
+		{glob: "a/**", want: `a/.*`},
+		{glob: "a/**/b", want: `a/(.*/)?b`},
+		{glob: "[abc].txt", want: `[abc]\.txt`},
+		{glob: "[!abc]", want: `[^abc]`},
+		{glob: "[unclosed", want: `\[unclosed`},
+		{glob: `\*literal`, want: `\*literal`},
+	}
+	for _, tt := range tests {
+		if got := globToRegexp(tt.glob); got != tt.want {
+			t.Errorf("globToRegexp(%q) = %q, want %q", tt.glob, got, tt.want)
+		}
+	}
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{name: "unanchored at root", patterns: []string{"*.log"}, path: "a.log", want: true},
+		{name: "unanchored at depth", patterns: []string{"*.log"}, path: "x/y/a.log", want: true},
+		{name: "unanchored no match", patterns: []string{"*.log"}, path: "a.logx", want: false},
+		{name: "star does not cross slash", patterns: []string{"a*b"}, path: "a/b", want: false},
+		{name: "question mark", patterns: []string{"a?c"}, path: "abc", want: true},
+		{name: "comment and blank", patterns: []string{"# a.log", ""}, path: "# a.log", want: false},
+
+		{name: "anchored at root", patterns: []string{"/build"}, path: "build", isDir: true, want: true},
+		{name: "anchored not at depth", patterns: []string{"/build"}, path: "x/build", isDir: true, want: false},
+		{name: "inner slash anchors", patterns: []string{"x/build"}, path: "y/x/build", want: false},
+
+		{name: "trailing slash matches dir", patterns: []string{"build/"}, path: "build", isDir: true, want: true},
+		{name: "trailing slash skips file", patterns: []string{"build/"}, path: "build", want: false},
+		{name: "trailing slash excludes contents", patterns: []string{"build/"}, path: "build/a.txt", want: true},
+		{name: "trailing slash at depth", patterns: []string{"build/"}, path: "x/build/a.txt", want: true},
+
+		{name: "double star prefix at root", patterns: []string{"**/tmp"}, path: "tmp", want: true},
+		{name: "double star prefix at depth", patterns: []string{"**/tmp"}, path: "a/b/tmp", want: true},
+		{name: "double star suffix", patterns: []string{"a/**"}, path: "a/x/y", want: true},
+		{name: "double star suffix not dir itself", patterns: []string{"a/**"}, path: "a", isDir: true, want: false},
+		{name: "double star middle no dirs", patterns: []string{"docs/**/*.md"}, path: "docs/a.md", want: true},
+		{name: "double star middle many dirs", patterns: []string{"docs/**/*.md"}, path: "docs/x/y/a.md", want: true},
+		{name: "double star middle other root", patterns: []string{"docs/**/*.md"}, path: "a.md", want: false},
+
+		{name: "negation re-includes", patterns: []string{"*.log", "!keep.log"}, path: "keep.log", want: false},
+		{name: "negation leaves others", patterns: []string{"*.log", "!keep.log"}, path: "a.log", want: true},
+		{name: "last match wins", patterns: []string{"!keep.log", "*.log"}, path: "keep.log", want: true},
+		{name: "negation cannot re-include in excluded dir", patterns: []string{"dir/", "!dir/keep"}, path: "dir/keep", want: true},
+
+		{name: "char class", patterns: []string{"[ab].txt"}, path: "b.txt", want: true},
+		{name: "negated char class", patterns: []string{"[!ab].txt"}, path: "a.txt", want: false},
+		{name: "escaped star", patterns: []string{`\*.txt`}, path: "*.txt", want: true},
+		{name: "escaped star no glob", patterns: []string{`\*.txt`}, path: "a.txt", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patterns, err := parseIgnorePatterns(tt.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := patterns.ignored(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("ignored(%q, %v) with %q = %v, want %v", tt.path, tt.isDir, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
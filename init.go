@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/build/constraint"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v3"
+)
+
+var initCmd = &cli.Command{
+	Name:  "init",
+	Usage: "create a config file with a service for every main package",
+	Description: `
+		Lists all packages of the module, or of all modules of the go.work workspace, and proposes a service for every main package.
+		Service names are derived from the import paths. Build tags that are used by the sources of a service are listed as comments.
+		The proposed config is printed and only written after confirmation, unless --yes is given.
+	`,
+	Action: initAction,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "write the config without asking for confirmation",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "overwrite an existing config file",
+		},
+	},
+}
+
+// initPackage is the subset of go list -json output that is relevant for discovering services.
+type initPackage struct {
+	ImportPath string
+	Dir        string
+	Name       string
+	Deps       []string
+
+	GoFiles, CgoFiles, IgnoredGoFiles []string
+}
+
+// initService is a proposed service together with the build tags its sources use.
+type initService struct {
+	name       string
+	pkg        string
+	importPath string
+	tags       []string
+}
+
+func initAction(ctx context.Context, c *cli.Command) error {
+	path := c.String("config")
+	if _, err := os.Stat(path); err == nil && !c.Bool("force") {
+		return fmt.Errorf("config file %s already exists, use --force to overwrite it", path)
+	}
+	root := filepath.Dir(path)
+
+	services, err := discoverServices(ctx, root)
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		return fmt.Errorf("no main packages found in %s", root)
+	}
+
+	data := generateConfig(services)
+
+	// make sure that the generated config can be loaded again
+	var config Config
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse generated config: %w", err)
+	}
+
+	if !c.Bool("yes") {
+		fmt.Printf("%s\n", data)
+		ok, err := confirm(os.Stdin, fmt.Sprintf("Write %s?", path))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("aborted")
+		}
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	slog.Info("wrote config file", "path", path, "services", len(services))
+	return nil
+}
+
+func confirm(r io.Reader, question string) (bool, error) {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("failed to read answer: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// discoverServices lists the packages of all main modules, i.e. the module in root or all modules of its
+// workspace, and returns a service for every main package.
+func discoverServices(ctx context.Context, root string) ([]initService, error) {
+	run := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, goBinary(), args...)
+		cmd.Dir = root
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run go %s: %w: %s", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return out, nil
+	}
+
+	out, err := run("list", "-m", "-f", "{{.Path}}")
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, mod := range strings.Fields(string(out)) {
+		patterns = append(patterns, mod+"/...")
+	}
+
+	out, err = run(slices.Concat([]string{"list", "-e", "-json"}, patterns)...)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []initPackage
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pkg initPackage
+		if err := dec.Decode(&pkg); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse go list output: %w", err)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+
+	knownTags, err := platformTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	localPkgs := make(map[string]initPackage, len(pkgs))
+	for _, pkg := range pkgs {
+		localPkgs[pkg.ImportPath] = pkg
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute project root: %w", err)
+	}
+
+	var services []initService
+	for _, pkg := range pkgs {
+		if pkg.Name != "main" {
+			continue
+		}
+
+		svc := initService{pkg: pkg.ImportPath, importPath: pkg.ImportPath}
+		if rel, err := filepath.Rel(absRoot, pkg.Dir); err == nil && rel == "." {
+			svc.pkg = "."
+		} else if err == nil && filepath.IsLocal(rel) {
+			svc.pkg = "./" + filepath.ToSlash(rel)
+		}
+
+		// the tags of all local packages in the dependency closure affect the binary
+		tags := make(map[string]bool)
+		for _, p := range append([]string{pkg.ImportPath}, pkg.Deps...) {
+			local, ok := localPkgs[p]
+			if !ok {
+				continue
+			}
+			if err := fileTags(local, knownTags, tags); err != nil {
+				return nil, err
+			}
+		}
+		svc.tags = sortedKeys(tags)
+
+		services = append(services, svc)
+	}
+
+	nameServices(services)
+	return services, nil
+}
+
+// nameServices derives the service names from the last element of the import paths. If names collide,
+// more elements are used until all names are unique.
+func nameServices(services []initService) {
+	depth := make([]int, len(services))
+	for i := range depth {
+		depth[i] = 1
+	}
+
+	for {
+		byName := make(map[string][]int)
+		for i := range services {
+			elems := strings.Split(services[i].importPath, "/")
+			n := min(depth[i], len(elems))
+			services[i].name = serviceName(strings.Join(elems[len(elems)-n:], "-"))
+			byName[services[i].name] = append(byName[services[i].name], i)
+		}
+
+		progress := false
+		for _, indices := range byName {
+			if len(indices) < 2 {
+				continue
+			}
+			for _, i := range indices {
+				if depth[i] < strings.Count(services[i].importPath, "/")+1 {
+					depth[i]++
+					progress = true
+				}
+			}
+		}
+		if !progress {
+			return
+		}
+	}
+}
+
+// serviceName turns s into a name that can be used as a file name in /bin.
+func serviceName(s string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, s)
+	return strings.Trim(name, "-.")
+}
+
+// platformTags returns the build tags that are set implicitly by the go command, e.g. for GOOS and GOARCH,
+// and which are therefore not worth proposing.
+func platformTags(ctx context.Context) (map[string]bool, error) {
+	tags := map[string]bool{"cgo": true, "gc": true, "gccgo": true, "unix": true, "ignore": true}
+
+	platforms, err := goPlatforms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, platform := range platforms {
+		tags[platform.OS] = true
+		tags[platform.Architecture] = true
+	}
+	return tags, nil
+}
+
+// fileTags adds the build tags of the package's //go:build lines to tags, except for implicit ones.
+func fileTags(pkg initPackage, knownTags map[string]bool, tags map[string]bool) error {
+	for _, file := range slices.Concat(pkg.GoFiles, pkg.CgoFiles, pkg.IgnoredGoFiles) {
+		data, err := os.ReadFile(filepath.Join(pkg.Dir, file))
+		if err != nil {
+			return fmt.Errorf("failed to read source file: %w", err)
+		}
+
+		for line := range strings.Lines(string(data)) {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "package ") {
+				break // build constraints must appear before the package clause
+			}
+			if !constraint.IsGoBuild(line) {
+				continue
+			}
+			expr, err := constraint.Parse(line)
+			if err != nil {
+				continue // go build reports invalid constraints
+			}
+			expr.Eval(func(tag string) bool {
+				if !knownTags[tag] && !strings.HasPrefix(tag, "go1.") && !strings.HasPrefix(tag, "goexperiment.") {
+					tags[tag] = true
+				}
+				return false
+			})
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// generateConfig returns a commented config with the given services. Optional settings are included as
+// comments, so that the config documents itself.
+func generateConfig(services []initService) []byte {
+	var b strings.Builder
+
+	b.WriteString(`# Generated by bespoke init.
+#
+# Settings in [defaults] apply to all services, and services can override them. Lists replace the
+# defaults, unless their first element is "...", which appends to them instead. Values can reference
+# environment variables as ${VAR}, ${VAR:-default} or ${VAR:?message}, and $$ is a literal $.
+
+# Build one image per service instead of a single image containing all services.
+# perServiceImages = false
+
+# Strip timestamps from images and binaries, so that repeated builds are bit-for-bit identical.
+# reproducible = false
+
+# Generate SBOMs (spdx and/or cyclonedx) and record SLSA provenance for built images.
+# sbom = ["spdx"]
+# provenance = false
+
+# Where to take the CA certificates from: system, file, embedded or url.
+# [caBundle]
+# source = "system"
+
+[defaults]
+GOOS = "linux"
+GOARCH = "amd64"
+# Build a multi-platform image index instead, takes precedence over GOOS/GOARCH.
+# platforms = ["linux/amd64", "linux/arm64"]
+# baseImage = "gcr.io/distroless/static-debian12"
+# additionalFlags = ["-trimpath"]
+
+# Package variables that are set to the git version at build time.
+# [defaults.versionVars]
+# version = "main.version"
+
+# Profiles are selected with --profile and layered over the defaults and services. Lists starting with "..."
+# extend the list of the previous layers, even if that is not set.
+# [profiles.prod]
+# additionalFlags = ["...", "-ldflags=-s -w"]
+`)
+
+	b.WriteString("\n# The first service is the entrypoint of the image, unless another one is marked with default = true.")
+	for _, svc := range services {
+		b.WriteString("\n[[services]]\n")
+		fmt.Fprintf(&b, "name = %q\n", svc.name)
+		fmt.Fprintf(&b, "package = %q\n", svc.pkg)
+		if len(svc.tags) > 0 {
+			quoted := make([]string, len(svc.tags))
+			for j, tag := range svc.tags {
+				quoted[j] = fmt.Sprintf("%q", tag)
+			}
+			b.WriteString("# build tags used by the sources of this service:\n")
+			fmt.Fprintf(&b, "# tags = [%s]\n", strings.Join(quoted, ", "))
+		}
+	}
+
+	return []byte(b.String())
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestGenerateConfigProfile(t *testing.T) {
+	data := string(generateConfig([]initService{{name: "app", pkg: "./cmd/app"}}))
+
+	// uncomment only the suggested profile, which must work without the commented defaults
+	var lines []string
+	inProfile := false
+	for line := range strings.Lines(data) {
+		if strings.HasPrefix(line, "# [profiles.") {
+			inProfile = true
+		} else if !strings.HasPrefix(line, "# ") {
+			inProfile = false
+		}
+		if inProfile {
+			line = strings.TrimPrefix(line, "# ")
+		}
+		lines = append(lines, line)
+	}
+
+	var cfg Config
+	if _, err := toml.Decode(strings.Join(lines, ""), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Profiles["prod"]; !ok {
+		t.Fatal("generated config suggests no prod profile")
+	}
+	cfg.profile = "prod"
+
+	svc := cfg.mergedServices()[0]
+	if svc.AdditionalFlags == nil || slices.Contains(*svc.AdditionalFlags, arrayAppendPlaceholder) {
+		t.Errorf("additionalFlags = %v, want the flags of the profile", svc.AdditionalFlags)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"context"
+	"debug/buildinfo"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/urfave/cli/v3"
+)
+
+var inspectCmd = &cli.Command{
+	Name:      "inspect",
+	Usage:     "show the services, layers, CA bundle and build info of built images",
+	ArgsUsage: "<image>",
+	Description: `
+		The image is a docker tarball (tarball:<file>), an OCI image layout directory (oci:<dir>) or a registry reference.
+		Existing files and directories are detected without prefix. All images of tarballs, layouts and indexes are shown.
+	`,
+	Action: inspectAction,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print JSON instead of a table, including the complete build info of every binary",
+		},
+	},
+}
+
+// inspectedImage is a single platform image found in the inspected source.
+type inspectedImage struct {
+	ref   string // reference or, if the image is untagged, its digest
+	image v1.Image
+}
+
+type imageReport struct {
+	Reference  string          `json:"reference"`
+	Digest     string          `json:"digest"`
+	Platform   string          `json:"platform,omitempty"`
+	Created    time.Time       `json:"created"`
+	Entrypoint []string        `json:"entrypoint"`
+	Cmd        []string        `json:"cmd,omitempty"`
+	User       string          `json:"user,omitempty"`
+	Services   []serviceReport `json:"services"`
+	CABundle   *caBundleReport `json:"caBundle,omitempty"`
+	Layers     []layerReport   `json:"layers"`
+}
+
+type serviceReport struct {
+	Name      string               `json:"name"`
+	Path      string               `json:"path"`
+	Size      int64                `json:"size"`
+	BuildInfo *buildinfo.BuildInfo `json:"buildInfo"`
+}
+
+type caBundleReport struct {
+	Path         string `json:"path"`
+	Date         string `json:"date,omitempty"`
+	Certificates int    `json:"certificates"`
+	SHA256       string `json:"sha256"`
+}
+
+type layerReport struct {
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	MediaType string `json:"mediaType"`
+}
+
+func inspectAction(ctx context.Context, c *cli.Command) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("expected exactly one image")
+	}
+
+	images, err := loadInspectedImages(ctx, c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	var reports []imageReport
+	for _, image := range images {
+		report, err := inspectImage(image)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %w", image.ref, err)
+		}
+		reports = append(reports, report)
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	}
+	return printImageReports(os.Stdout, reports)
+}
+
+// loadInspectedImages loads all images from a docker tarball, an OCI image layout or a registry, using the
+// same prefixes as base images.
+func loadInspectedImages(ctx context.Context, source string) ([]inspectedImage, error) {
+	var kind string
+	switch {
+	case strings.HasPrefix(source, baseImagePrefixTarball):
+		kind, source = baseImagePrefixTarball, strings.TrimPrefix(source, baseImagePrefixTarball)
+	case strings.HasPrefix(source, baseImagePrefixOCI):
+		kind, source = baseImagePrefixOCI, strings.TrimPrefix(source, baseImagePrefixOCI)
+	default:
+		if info, err := os.Stat(source); err == nil {
+			kind = baseImagePrefixTarball
+			if info.IsDir() {
+				kind = baseImagePrefixOCI
+			}
+		}
+	}
+
+	switch kind {
+	case baseImagePrefixTarball:
+		images, err := loadTarballImages(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load images from tarball %s: %w", source, err)
+		}
+		return images, nil
+
+	case baseImagePrefixOCI:
+		index, err := layout.ImageIndexFromPath(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load OCI image layout %s: %w", source, err)
+		}
+		images, err := indexImages(index, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to load images from OCI image layout %s: %w", source, err)
+		}
+		return images, nil
+
+	default:
+		ref, err := name.ParseReference(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse reference: %w", err)
+		}
+		desc, err := remote.Get(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %w", ref, err)
+		}
+		if desc.MediaType.IsIndex() {
+			index, err := desc.ImageIndex()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get image index %s: %w", ref, err)
+			}
+			return indexImages(index, ref.String())
+		}
+		image, err := desc.Image()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get image %s: %w", ref, err)
+		}
+		return []inspectedImage{{ref: ref.String(), image: image}}, nil
+	}
+}
+
+// loadTarballImages loads every image of a docker tarball by its first tag.
+func loadTarballImages(path string) ([]inspectedImage, error) {
+	opener := func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []inspectedImage
+	for _, desc := range manifest {
+		var tag *name.Tag
+		ref := desc.Config
+		if len(desc.RepoTags) != 0 {
+			parsed, err := name.NewTag(desc.RepoTags[0])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse tag: %w", err)
+			}
+			tag, ref = &parsed, desc.RepoTags[0]
+		} else if len(manifest) > 1 {
+			return nil, fmt.Errorf("untagged image %s cannot be selected from a tarball with multiple images", desc.Config)
+		}
+
+		image, err := tarball.Image(opener, tag)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, inspectedImage{ref: ref, image: image})
+	}
+	return images, nil
+}
+
+// indexImages returns all images of the index, including nested indexes. Images are named by the reference
+// annotation of their top-level descriptor, falling back to ref and then to their digest.
+func indexImages(index v1.ImageIndex, ref string) ([]inspectedImage, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []inspectedImage
+	for _, desc := range manifest.Manifests {
+		descRef := ref
+		if annotated := desc.Annotations[ociRefNameAnnotation]; annotated != "" {
+			descRef = annotated
+		}
+		if descRef == "" {
+			descRef = desc.Digest.String()
+		}
+
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			childImages, err := indexImages(child, descRef)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, childImages...)
+		case desc.MediaType.IsImage():
+			image, err := index.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, inspectedImage{ref: descRef, image: image})
+		}
+	}
+	return images, nil
+}
+
+// inspectImage reads the image's config and layers and scans its file system for Go binaries in /bin and
+// for the CA bundle.
+func inspectImage(img inspectedImage) (imageReport, error) {
+	digest, err := img.image.Digest()
+	if err != nil {
+		return imageReport{}, fmt.Errorf("failed to get digest: %w", err)
+	}
+	cf, err := img.image.ConfigFile()
+	if err != nil {
+		return imageReport{}, fmt.Errorf("failed to get config file: %w", err)
+	}
+
+	report := imageReport{
+		Reference:  img.ref,
+		Digest:     digest.String(),
+		Created:    cf.Created.Time,
+		Entrypoint: cf.Config.Entrypoint,
+		Cmd:        cf.Config.Cmd,
+		User:       cf.Config.User,
+		Services:   []serviceReport{},
+	}
+	if platform := cf.Platform(); platform != nil {
+		report.Platform = platform.String()
+	}
+
+	layers, err := img.image.Layers()
+	if err != nil {
+		return imageReport{}, fmt.Errorf("failed to get layers: %w", err)
+	}
+	for _, layer := range layers {
+		layerDigest, err := layer.Digest()
+		if err != nil {
+			return imageReport{}, fmt.Errorf("failed to get layer digest: %w", err)
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return imageReport{}, fmt.Errorf("failed to get layer size: %w", err)
+		}
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return imageReport{}, fmt.Errorf("failed to get layer media type: %w", err)
+		}
+		report.Layers = append(report.Layers, layerReport{Digest: layerDigest.String(), Size: size, MediaType: string(mediaType)})
+	}
+
+	// walk the flattened file system, which already accounts for whiteouts of later layers
+	rc := mutate.Extract(img.image)
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imageReport{}, fmt.Errorf("failed to read file system: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		filePath := path.Clean("/" + header.Name)
+		switch {
+		case path.Dir(filePath) == "/bin":
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return imageReport{}, fmt.Errorf("failed to read %s: %w", filePath, err)
+			}
+			info, err := buildinfo.Read(bytes.NewReader(data))
+			if err != nil {
+				continue // not a Go binary
+			}
+			report.Services = append(report.Services, serviceReport{
+				Name:      path.Base(filePath),
+				Path:      filePath,
+				Size:      header.Size,
+				BuildInfo: info,
+			})
+
+		case filePath == caBundlePath:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return imageReport{}, fmt.Errorf("failed to read %s: %w", filePath, err)
+			}
+			report.CABundle = &caBundleReport{
+				Path:         filePath,
+				Date:         caBundleDate(data),
+				Certificates: bytes.Count(data, []byte("-----BEGIN CERTIFICATE-----")),
+				SHA256:       sha256Hex(data),
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func printImageReports(w io.Writer, reports []imageReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	for i, report := range reports {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "Image:\t%s\n", report.Reference)
+		fmt.Fprintf(tw, "Digest:\t%s\n", report.Digest)
+		if report.Platform != "" {
+			fmt.Fprintf(tw, "Platform:\t%s\n", report.Platform)
+		}
+		fmt.Fprintf(tw, "Created:\t%s\n", report.Created.Format(time.RFC3339))
+		fmt.Fprintf(tw, "Entrypoint:\t%s\n", strings.Join(report.Entrypoint, " "))
+		if len(report.Cmd) != 0 {
+			fmt.Fprintf(tw, "Cmd:\t%s\n", strings.Join(report.Cmd, " "))
+		}
+		if report.User != "" {
+			fmt.Fprintf(tw, "User:\t%s\n", report.User)
+		}
+		if report.CABundle != nil {
+			fmt.Fprintf(tw, "CA bundle:\t%s, %d certificates, %s\n", cmp.Or(report.CABundle.Date, "unknown date"), report.CABundle.Certificates, report.CABundle.Path)
+		} else {
+			fmt.Fprintf(tw, "CA bundle:\tnone\n")
+		}
+
+		fmt.Fprintf(tw, "\nSERVICE\tPATH\tSIZE\tGO\tPACKAGE\tVERSION\tREVISION\n")
+		for _, svc := range report.Services {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				svc.Name, svc.Path, formatSize(svc.Size), svc.BuildInfo.GoVersion, svc.BuildInfo.Path,
+				svc.BuildInfo.Main.Version, buildSetting(svc.BuildInfo, "vcs.revision"))
+		}
+
+		fmt.Fprintf(tw, "\nLAYER\tSIZE\tMEDIA TYPE\n")
+		for _, layer := range report.Layers {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", layer.Digest, formatSize(layer.Size), layer.MediaType)
+		}
+	}
+
+	return tw.Flush()
+}
+
+func buildSetting(info *debug.BuildInfo, key string) string {
+	for _, setting := range info.Settings {
+		if setting.Key == key {
+			return setting.Value
+		}
+	}
+	return "-"
+}
+
+// formatSize formats a number of bytes with a binary unit, e.g. 1.5 MiB.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
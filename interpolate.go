@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// expandEnv replaces references to environment variables in s:
+//
+//	${VAR}          value of VAR, empty if it is not set
+//	${VAR:-default} value of VAR, or default if it is not set or empty
+//	${VAR:?message} value of VAR, or an error with message if it is not set or empty
+//	$$              a literal $, e.g. $${VAR} results in ${VAR}
+//
+// Defaults and messages are expanded as well, e.g. ${VAR:-${OTHER}}, but only if they are used.
+// A $ that is not followed by { or $ is kept as is, so that values like $ORIGIN need no escaping.
+func expandEnv(s string, lookup func(string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case '{':
+		default:
+			b.WriteByte('$')
+			continue
+		}
+
+		end := closingBrace(s[i+2:])
+		if end < 0 {
+			return "", fmt.Errorf("missing closing brace for ${ at position %d in %q", i, s)
+		}
+		expr := s[i+2 : i+2+end]
+		i += 2 + end
+
+		value, err := expandEnvExpr(expr, lookup)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+// closingBrace returns the index of the } that closes an expression starting at the beginning of s, skipping
+// nested expressions, or -1 if there is none.
+func closingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '$':
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}' && depth == 0:
+			return i
+		case s[i] == '}':
+			depth--
+		}
+	}
+	return -1
+}
+
+// expandEnvExpr evaluates the expression between ${ and }.
+func expandEnvExpr(expr string, lookup func(string) (string, bool)) (string, error) {
+	name, op, arg := expr, "", ""
+	if i := strings.Index(expr, ":"); i >= 0 {
+		name, op, arg = expr[:i], expr[i:min(i+2, len(expr))], expr[min(i+2, len(expr)):]
+	}
+	if !isEnvName(name) {
+		return "", fmt.Errorf("invalid variable name %q in ${%s}", name, expr)
+	}
+
+	value, _ := lookup(name)
+	switch op {
+	case "":
+		return value, nil
+	case ":-":
+		if value == "" {
+			return expandEnv(arg, lookup)
+		}
+		return value, nil
+	case ":?":
+		if value == "" {
+			if arg == "" {
+				return "", fmt.Errorf("variable %s is required", name)
+			}
+			msg, err := expandEnv(arg, lookup)
+			if err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("variable %s: %s", name, msg)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported operator %q in ${%s}, expected :- or :?", op, expr)
+	}
+}
+
+func isEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// interpolateConfig expands environment variables in all string values of the config. Profiles other than
+// the selected one are skipped, so that they can require variables that are only set when they are used.
+// Errors point at the key and line of the offending value.
+func interpolateConfig(cfg *Config, lookup func(string) (string, bool)) error {
+	positions := scanConfigPositions(cfg.raw)
+
+	var errs []error
+	var walk func(v reflect.Value, key []string, service int)
+	walk = func(v reflect.Value, key []string, service int) {
+		switch v.Kind() {
+		case reflect.String:
+			expanded, err := expandEnv(v.String(), lookup)
+			if err != nil {
+				k := joinConfigKey(key)
+				line := positions.line(k)
+				if service >= 0 {
+					line = positions.serviceLine(service, strings.TrimPrefix(k, "services."))
+				}
+				errs = append(errs, fmt.Errorf("%s:%d: %s: %w", cfg.path, line, k, err))
+				return
+			}
+			v.SetString(expanded)
+
+		case reflect.Pointer:
+			if !v.IsNil() {
+				walk(v.Elem(), key, service)
+			}
+
+		case reflect.Slice:
+			for i := range v.Len() {
+				if len(key) == 1 && key[0] == "services" {
+					service = i
+				}
+				walk(v.Index(i), key, service)
+			}
+
+		case reflect.Map:
+			// map values are not addressable, so they are expanded in a copy
+			iter := v.MapRange()
+			for iter.Next() {
+				if len(key) == 1 && key[0] == "profiles" && iter.Key().String() != cfg.profile {
+					continue
+				}
+				elem := reflect.New(iter.Value().Type()).Elem()
+				elem.Set(iter.Value())
+				walk(elem, append(key[:len(key):len(key)], iter.Key().String()), service)
+				v.SetMapIndex(iter.Key(), elem)
+			}
+
+		case reflect.Struct:
+			for i := range v.NumField() {
+				field := v.Type().Field(i)
+				if !field.IsExported() || field.Tag.Get("toml") == "-" {
+					continue
+				}
+				if field.Anonymous && field.Tag.Get("toml") == "" {
+					walk(v.Field(i), key, service)
+					continue
+				}
+				walk(v.Field(i), append(key[:len(key):len(key)], configFieldName(field)), service)
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), nil, -1)
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{"NAME": "app", "EMPTY": "", "TAG": "v1"}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: "plain", want: "plain"},
+		{in: "${NAME}", want: "app"},
+		{in: "img-${NAME}:${TAG}", want: "img-app:v1"},
+		{in: "${UNSET}", want: ""},
+
+		{in: "${NAME:-default}", want: "app"},
+		{in: "${UNSET:-default}", want: "default"},
+		{in: "${EMPTY:-default}", want: "default"},
+		{in: "${UNSET:-}", want: ""},
+		{in: "${UNSET:-${NAME}}", want: "app"},
+		{in: "${UNSET:-${OTHER:-x}-${TAG}}", want: "x-v1"},
+		{in: "${UNSET:-$${NAME}}", want: "${NAME}"},
+		{in: "${NAME:-${MISSING:?not used}}", want: "app"},
+
+		{in: "${NAME:?required}", want: "app"},
+		{in: "${UNSET:?set it}", wantErr: "variable UNSET: set it"},
+		{in: "${EMPTY:?}", wantErr: "variable EMPTY is required"},
+		{in: "${UNSET:?use ${NAME}}", wantErr: "variable UNSET: use app"},
+
+		{in: "$$", want: "$"},
+		{in: "$${NAME}", want: "${NAME}"},
+		{in: "$$$$", want: "$$"},
+
+		{in: "$", want: "$"},
+		{in: "a$", want: "a$"},
+		{in: "$ORIGIN/lib", want: "$ORIGIN/lib"},
+		{in: "100$ off", want: "100$ off"},
+
+		{in: "${NAME", wantErr: "missing closing brace for ${ at position 0"},
+		{in: "x-${UNSET:-${NAME}", wantErr: "missing closing brace for ${ at position 2"},
+		{in: "${}", wantErr: "invalid variable name"},
+		{in: "${1A}", wantErr: "invalid variable name"},
+		{in: "${NAME-x}", wantErr: "invalid variable name"},
+		{in: "${NAME:+x}", wantErr: "unsupported operator"},
+	}
+	for _, tt := range tests {
+		got, err := expandEnv(tt.in, lookup)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expandEnv(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandEnv(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
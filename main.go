@@ -9,7 +9,13 @@ import (
 )
 
 func main() {
-	cmd := &cli.Command{
+	if err := newRootCmd().Run(context.Background(), os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newRootCmd() *cli.Command {
+	return &cli.Command{
 		Name:  "bespoke",
 		Usage: "build and push docker images",
 		Flags: []cli.Flag{
@@ -20,12 +26,22 @@ func main() {
 				Required: false,
 				Value:    "bespoke.toml",
 			},
+			&cli.StringFlag{
+				Name:    "profile",
+				Aliases: []string{"p"},
+				Usage:   "name of the profile in the config file to apply",
+				Sources: cli.EnvVars("BESPOKE_PROFILE"),
+			},
 		},
 		Commands: []*cli.Command{
+			initCmd,
+			validateCmd,
+			configCmd,
 			buildCmd,
+			verifyCmd,
+			inspectCmd,
+			runCmd,
+			watchCmd,
 		},
 	}
-	if err := cmd.Run(context.Background(), os.Args); err != nil {
-		log.Fatal(err)
-	}
 }
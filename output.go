@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"slices"
+	"text/template"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	outputFormatDocker = "docker"
+	outputFormatOCI    = "oci"
+)
+
+// imageOutput is a built image or, for multi-platform builds, a built image index.
+type imageOutput struct {
+	name  string // name of the (first) service in the image, used in reference templates
+	image v1.Image
+	index v1.ImageIndex
+
+	services []ConfigService
+	binaries [][]builtBinary // indexed by platform and then by service
+}
+
+// descriptor returns the descriptor of the output's image or index.
+func (o imageOutput) descriptor() (*v1.Descriptor, error) {
+	if o.index != nil {
+		return partial.Descriptor(o.index)
+	}
+	return partial.Descriptor(o.image)
+}
+
+// images returns the output's image or the images of all platforms of its index.
+func (o imageOutput) images() ([]v1.Image, error) {
+	if o.index == nil {
+		return []v1.Image{o.image}, nil
+	}
+	manifest, err := o.index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get index manifest: %w", err)
+	}
+	var images []v1.Image
+	for _, desc := range manifest.Manifests {
+		image, err := o.index.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get image %s from index: %w", desc.Digest, err)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// refTemplateData is passed to the tag and push reference templates. Git values are only read from the
+// repository if a template uses them.
+type refTemplateData struct {
+	Name string // name of the service
+	Tag  string // value of the image-tag flag
+	Date string // build date as YYYYMMDD
+
+	git func() (gitInfo, error)
+}
+
+func (d refTemplateData) Commit() (string, error) {
+	info, err := d.git()
+	return info.Commit, err
+}
+
+func (d refTemplateData) ShortSHA() (string, error) {
+	info, err := d.git()
+	return info.ShortSHA, err
+}
+
+// Branch returns the current branch with all characters that are invalid in tags replaced by dashes.
+func (d refTemplateData) Branch() (string, error) {
+	info, err := d.git()
+	if err != nil {
+		return "", err
+	}
+	if info.Branch == "" {
+		return "", fmt.Errorf("HEAD is detached")
+	}
+	return invalidTagChars.ReplaceAllString(info.Branch, "-"), nil
+}
+
+func (d refTemplateData) Describe() (string, error) {
+	info, err := d.git()
+	return info.Describe, err
+}
+
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+func resolveRef(tmpl string, data refTemplateData) (string, error) {
+	t, err := template.New("ref").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse reference template %q: %w", tmpl, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute reference template %q: %w", tmpl, err)
+	}
+	return buf.String(), nil
+}
+
+// writeOutputs pushes the outputs to a registry or writes them to a file, depending on the given flags.
+// Every output is written to all references resolved from the tag or push templates. If the outputs are
+// pushed, the references of every output are returned.
+func writeOutputs(ctx context.Context, c *cli.Command, outputs []imageOutput, perService bool, data refTemplateData) ([][]name.Reference, error) {
+	tmpls := c.StringSlice("push")
+	push := len(tmpls) != 0
+	if !push {
+		tmpls = c.StringSlice("tag")
+		if len(tmpls) == 0 {
+			tmpls = []string{"bespoke:{{.Tag}}"}
+			if perService {
+				tmpls = []string{"{{.Name}}:{{.Tag}}"}
+			}
+		}
+	}
+
+	// resolve references
+	var (
+		refs   = make([][]name.Reference, len(outputs))
+		seen   = make(map[string]string)
+		hasIdx bool
+	)
+	for i, output := range outputs {
+		data.Name = output.name
+		for _, tmpl := range tmpls {
+			resolved, err := resolveRef(tmpl, data)
+			if err != nil {
+				return nil, err
+			}
+			ref, err := name.ParseReference(resolved)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse reference: %w", err)
+			}
+			if other, ok := seen[ref.Name()]; ok {
+				if other == output.name {
+					continue // multiple templates may resolve to the same reference
+				}
+				return nil, fmt.Errorf("services %s and %s resolve to the same reference %s", other, output.name, ref)
+			}
+			seen[ref.Name()] = output.name
+			refs[i] = append(refs[i], ref)
+		}
+		hasIdx = hasIdx || output.index != nil
+	}
+
+	if push {
+		if err := pushOutputs(ctx, outputs, refs); err != nil {
+			return nil, err
+		}
+		return refs, nil
+	}
+
+	tags := make([][]name.Tag, len(outputs))
+	for i := range outputs {
+		for _, ref := range refs[i] {
+			tag, ok := ref.(name.Tag)
+			if !ok {
+				return nil, fmt.Errorf("reference %s must be a tag", ref)
+			}
+			tags[i] = append(tags[i], tag)
+		}
+	}
+
+	format := c.String("format")
+	if !c.IsSet("format") && hasIdx {
+		format = outputFormatOCI // docker tarballs cannot hold an image index
+	}
+
+	switch format {
+	case outputFormatDocker:
+		if hasIdx {
+			return nil, fmt.Errorf("multi-platform images cannot be written as docker tarball, use format %s", outputFormatOCI)
+		}
+		if c.Bool("append") {
+			return nil, fmt.Errorf("append is only supported for format %s", outputFormatOCI)
+		}
+
+		refToImage := make(map[name.Reference]v1.Image)
+		for i, output := range outputs {
+			for _, tag := range tags[i] {
+				refToImage[tag] = output.image
+			}
+		}
+		if err := tarball.MultiRefWriteToFile(c.String("out"), refToImage); err != nil {
+			return nil, fmt.Errorf("failed to write image to file: %w", err)
+		}
+		return nil, nil
+
+	case outputFormatOCI:
+		return nil, writeOCILayout(c.String("out"), outputs, tags, c.Bool("append"))
+
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// writeOCILayout writes the outputs to an OCI image layout directory and annotates each of them with its
+// reference. If appendTo is set and the layout exists, outputs are added to it and replace existing
+// manifests with the same reference. Otherwise, the layout's index is recreated.
+func writeOCILayout(dir string, outputs []imageOutput, tags [][]name.Tag, appendTo bool) error {
+	slog.Info("writing OCI image layout", "path", dir, "append", appendTo)
+
+	var (
+		path layout.Path
+		err  error
+	)
+	if appendTo {
+		path, err = layout.FromPath(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+			appendTo = false
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open OCI image layout: %w", err)
+		}
+	}
+	if !appendTo {
+		path, err = layout.Write(dir, empty.Index)
+		if err != nil {
+			return fmt.Errorf("failed to create OCI image layout: %w", err)
+		}
+	}
+
+	for i, output := range outputs {
+		for _, tag := range tags[i] {
+			ref := tag.String()
+			opt := layout.WithAnnotations(map[string]string{
+				ociRefNameAnnotation: ref,
+			})
+			if output.index != nil {
+				err = path.ReplaceIndex(output.index, match.Name(ref), opt)
+			} else {
+				err = path.ReplaceImage(output.image, match.Name(ref), opt)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write image to OCI image layout: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// pushOutputs pushes every output once to its first reference. All other references are then tagged by
+// manifest only, unless they point to a different repository, which requires the blobs to be pushed again.
+func pushOutputs(ctx context.Context, outputs []imageOutput, refs [][]name.Reference) error {
+	opts := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+
+	var (
+		primary = make(map[name.Reference]remote.Taggable)
+		others  = make(map[name.Reference]remote.Taggable)
+		tags    []name.Tag
+		tagged  []remote.Taggable
+	)
+	for i, output := range outputs {
+		var taggable remote.Taggable = output.image
+		if output.index != nil {
+			taggable = output.index
+		}
+
+		primary[refs[i][0]] = taggable
+		slog.Info("pushing image to registry", "ref", refs[i][0].String())
+
+		for _, ref := range refs[i][1:] {
+			tag, ok := ref.(name.Tag)
+			if ok && ref.Context() == refs[i][0].Context() {
+				tags = append(tags, tag)
+				tagged = append(tagged, taggable)
+			} else {
+				others[ref] = taggable
+				slog.Info("pushing image to registry", "ref", ref.String())
+			}
+		}
+	}
+
+	if err := remote.MultiWrite(primary, opts...); err != nil {
+		return fmt.Errorf("failed to push image to registry: %w", err)
+	}
+	if len(others) != 0 {
+		if err := remote.MultiWrite(others, opts...); err != nil {
+			return fmt.Errorf("failed to push image to registry: %w", err)
+		}
+	}
+	for i, tag := range tags {
+		slog.Info("tagging image", "ref", tag.String())
+		if err := remote.Tag(tag, tagged[i], opts...); err != nil {
+			return fmt.Errorf("failed to tag image: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// repositories returns the distinct repositories of the given references.
+func repositories(refs []name.Reference) []name.Repository {
+	var repos []name.Repository
+	for _, ref := range refs {
+		if !slices.Contains(repos, ref.Context()) {
+			repos = append(repos, ref.Context())
+		}
+	}
+	return repos
+}
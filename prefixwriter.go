@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// outputMu serializes writes of all prefixWriters, so that lines of concurrent commands do not interleave.
+var outputMu sync.Mutex
+
+// prefixWriter prefixes every line written to it before passing it on to the underlying writer. Incomplete
+// lines are buffered until they are terminated or Flush is called.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{
+		w:      w,
+		prefix: []byte("[" + prefix + "] "),
+	}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+
+	var out []byte
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		out = append(out, p.prefix...)
+		out = append(out, p.buf[:i+1]...)
+		p.buf = p.buf[i+1:]
+	}
+
+	if len(out) != 0 {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		if _, err := p.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+// Flush writes any buffered incomplete line.
+func (p *prefixWriter) Flush() {
+	if len(p.buf) == 0 {
+		return
+	}
+	_, _ = p.Write([]byte("\n"))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+	provenanceBuildType = "https://github.com/tim-oster/bespoke/provenance/v1"
+	provenanceBuilderID = "https://github.com/tim-oster/bespoke"
+
+	inTotoMediaType       types.MediaType = "application/vnd.in-toto+json"
+	dsseEnvelopeMediaType types.MediaType = "application/vnd.dsse.envelope.v1+json"
+)
+
+// provenanceOptions are the build inputs that are recorded in the provenance of every output.
+type provenanceOptions struct {
+	configPath string
+	config     []byte // contents of the config file
+	profile    string
+	git        func() (gitInfo, error)
+	startedOn  time.Time
+}
+
+// provenanceStatement is an in-toto statement with a SLSA provenance predicate, see
+// https://slsa.dev/spec/v1.0/provenance.
+type provenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []provenanceResource `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     provenancePredicate  `json:"predicate"`
+}
+
+type provenanceResource struct {
+	Name        string            `json:"name,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	MediaType   string            `json:"mediaType,omitempty"`
+	Annotations map[string]any    `json:"annotations,omitempty"`
+}
+
+type provenancePredicate struct {
+	BuildDefinition provenanceBuildDefinition `json:"buildDefinition"`
+	RunDetails      provenanceRunDetails      `json:"runDetails"`
+}
+
+type provenanceBuildDefinition struct {
+	BuildType            string                       `json:"buildType"`
+	ExternalParameters   provenanceExternalParameters `json:"externalParameters"`
+	InternalParameters   provenanceInternalParameters `json:"internalParameters"`
+	ResolvedDependencies []provenanceResource         `json:"resolvedDependencies,omitempty"`
+}
+
+type provenanceExternalParameters struct {
+	ConfigPath string `json:"configPath"`
+	Config     string `json:"config"`
+	Profile    string `json:"profile,omitempty"`
+}
+
+type provenanceInternalParameters struct {
+	Services []provenanceService `json:"services"`
+}
+
+// provenanceService is the resolved go build invocation of a service for one platform.
+type provenanceService struct {
+	Name      string            `json:"name"`
+	Package   string            `json:"package"`
+	Platform  string            `json:"platform"`
+	GoVersion string            `json:"goVersion"`
+	Args      []string          `json:"args"`
+	Env       []string          `json:"env"`
+	Digest    map[string]string `json:"digest"`
+}
+
+type provenanceRunDetails struct {
+	Builder    provenanceBuilder    `json:"builder"`
+	Metadata   provenanceMetadata   `json:"metadata"`
+	Byproducts []provenanceResource `json:"byproducts,omitempty"`
+}
+
+type provenanceBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type provenanceMetadata struct {
+	StartedOn  string `json:"startedOn"`
+	FinishedOn string `json:"finishedOn"`
+}
+
+// dsseEnvelope is a signed in-toto statement, see https://github.com/secure-systems-lab/dsse.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// writeProvenance records how every output was built. If refs is set, the provenance is pushed as a
+// referrer of the outputs to all their repositories. Otherwise, it is written next to out. If key is set,
+// the statement is signed and wrapped in a DSSE envelope.
+func writeProvenance(ctx context.Context, outputs []imageOutput, refs [][]name.Reference, opts provenanceOptions, out string, key crypto.Signer) error {
+	for i, output := range outputs {
+		statement, err := newProvenanceStatement(output, opts)
+		if err != nil {
+			return err
+		}
+		if refs != nil {
+			statement.Subject[0].Name = refs[i][0].Context().Name()
+		}
+
+		data, err := json.MarshalIndent(statement, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal provenance: %w", err)
+		}
+		mediaType := inTotoMediaType
+		if key != nil {
+			data, err = signStatement(data, key)
+			if err != nil {
+				return err
+			}
+			mediaType = dsseEnvelopeMediaType
+		}
+
+		if refs == nil {
+			path := strings.TrimSuffix(out, filepath.Ext(out))
+			if len(outputs) > 1 {
+				path += "." + output.name
+			}
+			path += ".provenance.json"
+
+			slog.Info("writing provenance", "path", path)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				return fmt.Errorf("failed to write provenance: %w", err)
+			}
+			continue
+		}
+
+		subject, err := output.descriptor()
+		if err != nil {
+			return fmt.Errorf("failed to describe image: %w", err)
+		}
+		art, err := newArtifact(inTotoMediaType, []artifactBlob{{
+			mediaType:   mediaType,
+			data:        data,
+			annotations: map[string]string{"in-toto.io/predicate-type": slsaProvenanceType},
+		}}, subject, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create provenance artifact: %w", err)
+		}
+		if err := pushArtifacts(ctx, refs[i], art); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newProvenanceStatement(output imageOutput, opts provenanceOptions) (provenanceStatement, error) {
+	desc, err := output.descriptor()
+	if err != nil {
+		return provenanceStatement{}, fmt.Errorf("failed to describe image: %w", err)
+	}
+
+	statement := provenanceStatement{
+		Type: inTotoStatementType,
+		Subject: []provenanceResource{{
+			Name:   output.name,
+			Digest: map[string]string{desc.Digest.Algorithm: desc.Digest.Hex},
+		}},
+		PredicateType: slsaProvenanceType,
+	}
+
+	def := &statement.Predicate.BuildDefinition
+	def.BuildType = provenanceBuildType
+	def.ExternalParameters = provenanceExternalParameters{
+		ConfigPath: opts.configPath,
+		Config:     string(opts.config),
+		Profile:    opts.profile,
+	}
+
+	binaries, err := readSBOMBinaries(output)
+	if err != nil {
+		return provenanceStatement{}, err
+	}
+	k := 0
+	for _, platformBinaries := range output.binaries {
+		for j, binary := range platformBinaries {
+			info := binaries[k]
+			k++
+			def.InternalParameters.Services = append(def.InternalParameters.Services, provenanceService{
+				Name:      output.services[j].Name,
+				Package:   output.services[j].Package,
+				Platform:  info.platform,
+				GoVersion: info.info.GoVersion,
+				Args:      binary.args,
+				Env:       append([]string{}, binary.env...),
+				Digest:    map[string]string{"sha256": info.sha256},
+			})
+		}
+	}
+
+	if info, err := opts.git(); err != nil {
+		slog.Warn("failed to read git info, omitting source from provenance", "error", err)
+	} else {
+		def.ResolvedDependencies = append(def.ResolvedDependencies, provenanceResource{
+			Name:        "source",
+			Digest:      map[string]string{"gitCommit": info.Commit},
+			Annotations: map[string]any{"dirty": info.Dirty, "describe": info.Describe},
+		})
+	}
+
+	run := &statement.Predicate.RunDetails
+	run.Builder.ID = provenanceBuilderID
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		run.Builder.Version = map[string]string{"bespoke": bi.Main.Version}
+	}
+	run.Metadata = provenanceMetadata{
+		StartedOn:  opts.startedOn.Format(time.RFC3339),
+		FinishedOn: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	// record the layers of every platform image
+	images, err := output.images()
+	if err != nil {
+		return provenanceStatement{}, err
+	}
+	for _, image := range images {
+		cf, err := image.ConfigFile()
+		if err != nil {
+			return provenanceStatement{}, fmt.Errorf("failed to get config file: %w", err)
+		}
+		layers, err := image.Layers()
+		if err != nil {
+			return provenanceStatement{}, fmt.Errorf("failed to get layers: %w", err)
+		}
+		for _, layer := range layers {
+			digest, err := layer.Digest()
+			if err != nil {
+				return provenanceStatement{}, fmt.Errorf("failed to get layer digest: %w", err)
+			}
+			mediaType, err := layer.MediaType()
+			if err != nil {
+				return provenanceStatement{}, fmt.Errorf("failed to get layer media type: %w", err)
+			}
+			layerRes := provenanceResource{
+				Name:      "layer",
+				Digest:    map[string]string{digest.Algorithm: digest.Hex},
+				MediaType: string(mediaType),
+			}
+			if platform := cf.Platform(); platform != nil {
+				layerRes.Annotations = map[string]any{"platform": platform.String()}
+			}
+			run.Byproducts = append(run.Byproducts, layerRes)
+		}
+	}
+
+	return statement, nil
+}
+
+// signStatement wraps the statement in a DSSE envelope signed with the given key.
+func signStatement(statement []byte, key crypto.Signer) ([]byte, error) {
+	// pre-authentication encoding, see https://github.com/secure-systems-lab/dsse/blob/master/protocol.md
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(inTotoMediaType), inTotoMediaType, len(statement), statement)
+	signature, err := signPayload(key, []byte(pae))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign provenance: %w", err)
+	}
+
+	envelope := dsseEnvelope{
+		PayloadType: string(inTotoMediaType),
+		Payload:     base64.StdEncoding.EncodeToString(statement),
+		Signatures:  []dsseSignature{{Sig: base64.StdEncoding.EncodeToString(signature)}},
+	}
+	data, err := json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal DSSE envelope: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/urfave/cli/v3"
+)
+
+var runCmd = &cli.Command{
+	Name:      "run",
+	Usage:     "build a service for the host platform and run it locally",
+	ArgsUsage: "<service> [-- args...]",
+	Description: `
+		The service is built with the same settings as in images, but for the host platform.
+		It runs with the env of its image config added to the current environment, and with the image's cmd unless args are given.
+		Signals are forwarded to the service, and bespoke exits with the service's exit code.
+	`,
+	Action: runAction,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "rebuild the binary instead of reusing an unchanged one from the cache (BESPOKE_CACHE_DIR)",
+		},
+	},
+}
+
+func runAction(ctx context.Context, c *cli.Command) error {
+	if c.Args().Len() == 0 {
+		return fmt.Errorf("expected a service name")
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	svc, err := findService(cfg.mergedServices(), c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	binary, err := buildBinary(ctx, svc, hostPlatform(), localBinaryOptions(ctx, cfg, c.Bool("no-cache")))
+	if err != nil {
+		return fmt.Errorf("failed to build binary for service %s: %w", svc.Name, err)
+	}
+	defer os.Remove(binary.path)
+	if err := makeExecutable(binary.path); err != nil {
+		return err
+	}
+
+	args := c.Args().Tail()
+	if len(args) == 0 && svc.Image.Cmd != nil {
+		args = *svc.Image.Cmd
+	}
+
+	code, err := runService(svc, binary.path, args)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return cli.Exit("", code)
+	}
+	return nil
+}
+
+// localBinaryOptions returns the options for building binaries that run on the host.
+func localBinaryOptions(ctx context.Context, cfg Config, noCache bool) binaryOptions {
+	cacheDir, err := binaryCacheDir()
+	if err != nil {
+		slog.Warn("failed to determine cache directory, building without cache", "error", err)
+	}
+	created, _ := buildTime(false) // only fails for reproducible builds
+	return binaryOptions{
+		projectRoot: cfg.ProjectRoot,
+		buildTime:   created,
+		git: sync.OnceValues(func() (gitInfo, error) {
+			return readGitInfo(ctx, cfg.ProjectRoot)
+		}),
+		cacheDir: cacheDir,
+		noCache:  noCache,
+	}
+}
+
+// makeExecutable sets the executable bit of a built binary, which is missing if it was restored from the
+// cache.
+func makeExecutable(path string) error {
+	if err := os.Chmod(path, 0755); err != nil {
+		return fmt.Errorf("failed to make binary executable: %w", err)
+	}
+	return nil
+}
+
+// findService returns the service with the given name.
+func findService(services []ConfigService, name string) (ConfigService, error) {
+	for _, svc := range services {
+		if svc.Name == name {
+			return svc, nil
+		}
+	}
+	return ConfigService{}, fmt.Errorf("service %s not found in config", name)
+}
+
+// hostPlatform returns the platform bespoke runs on.
+func hostPlatform() *v1.Platform {
+	return &v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// serviceEnv returns the current environment with the env of the service's image config added.
+func serviceEnv(svc ConfigService) []string {
+	env := os.Environ()
+	if svc.Image.Env != nil {
+		env = mergeEnv(env, *svc.Image.Env)
+	}
+	return env
+}
+
+// runService runs the binary until it exits and forwards all signals that usually stop or reload a
+// process. It returns the binary's exit code.
+func runService(svc ConfigService, binary string, args []string) (int, error) {
+	cmd := exec.Command(binary, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = serviceEnv(svc)
+
+	// start listening before the process starts, so that no signal gets lost
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	slog.Info("running service", "service", svc.Name, "args", args)
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start service %s: %w", svc.Name, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case sig := <-signals:
+			slog.Debug("forwarding signal", "service", svc.Name, "signal", sig)
+			_ = cmd.Process.Signal(sig)
+
+		case err := <-done:
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+					return 128 + int(status.Signal()), nil // like shells report processes killed by a signal
+				}
+				return exitErr.ExitCode(), nil
+			}
+			if err != nil {
+				return 0, fmt.Errorf("failed to run service %s: %w", svc.Name, err)
+			}
+			return 0, nil
+		}
+	}
+}
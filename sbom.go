@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	sbomFormatSPDX      = "spdx"
+	sbomFormatCycloneDX = "cyclonedx"
+
+	spdxMediaType      types.MediaType = "application/spdx+json"
+	cycloneDXMediaType types.MediaType = "application/vnd.cyclonedx+json"
+)
+
+// sbomFormats maps the supported SBOM formats to their media type and file extension.
+var sbomFormats = map[string]struct {
+	mediaType types.MediaType
+	ext       string
+}{
+	sbomFormatSPDX:      {spdxMediaType, ".spdx.json"},
+	sbomFormatCycloneDX: {cycloneDXMediaType, ".cdx.json"},
+}
+
+// sbomBinary is a service binary together with the build info the go command embedded into it.
+type sbomBinary struct {
+	service  string
+	platform string
+	sha256   string
+	info     *buildinfo.BuildInfo
+}
+
+// sbomModule is a Go module as it ended up in a binary, i.e. with replacements applied.
+type sbomModule struct {
+	path    string
+	version string
+	sum     string
+}
+
+func (m sbomModule) purl() string {
+	purl := "pkg:golang/" + m.path
+	if m.version != "" && m.version != "(devel)" {
+		purl += "@" + m.version
+	}
+	return purl
+}
+
+// modules returns the main module and all dependencies of the binary, including the standard library.
+func (b sbomBinary) modules() (main sbomModule, deps []sbomModule) {
+	module := func(m *debug.Module) sbomModule {
+		if m.Replace != nil {
+			m = m.Replace
+		}
+		return sbomModule{path: m.Path, version: m.Version, sum: m.Sum}
+	}
+
+	main = module(&b.info.Main)
+	deps = append(deps, sbomModule{path: "stdlib", version: b.info.GoVersion})
+	for _, dep := range b.info.Deps {
+		deps = append(deps, module(dep))
+	}
+	return main, deps
+}
+
+// readSBOMBinaries reads the build info of all binaries of the output, just like go version -m does.
+func readSBOMBinaries(output imageOutput) ([]sbomBinary, error) {
+	var binaries []sbomBinary
+	for _, platformBinaries := range output.binaries {
+		for i, binary := range platformBinaries {
+			data, err := os.ReadFile(binary.path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read binary of service %s: %w", output.services[i].Name, err)
+			}
+			info, err := buildinfo.Read(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read build info of service %s: %w", output.services[i].Name, err)
+			}
+
+			settings := make(map[string]string)
+			for _, setting := range info.Settings {
+				settings[setting.Key] = setting.Value
+			}
+			platform := settings["GOOS"] + "/" + settings["GOARCH"]
+			if goarm := settings["GOARM"]; settings["GOARCH"] == "arm" && goarm != "" {
+				platform += "/v" + goarm
+			}
+
+			binaries = append(binaries, sbomBinary{
+				service:  output.services[i].Name,
+				platform: platform,
+				sha256:   sha256Hex(data),
+				info:     info,
+			})
+		}
+	}
+	return binaries, nil
+}
+
+// writeSBOMs generates an SBOM in each of the given formats for every output. If refs is set, the SBOMs are
+// pushed as referrers of the outputs to all their repositories. Otherwise, they are written next to out.
+func writeSBOMs(ctx context.Context, outputs []imageOutput, refs [][]name.Reference, formats []string, out string, created time.Time, caBundle []byte) error {
+	for i, output := range outputs {
+		binaries, err := readSBOMBinaries(output)
+		if err != nil {
+			return err
+		}
+
+		var blobs []artifactBlob
+		for _, format := range formats {
+			var doc any
+			switch format {
+			case sbomFormatSPDX:
+				doc = newSPDXDocument(output.name, binaries, caBundle, created)
+			case sbomFormatCycloneDX:
+				doc = newCycloneDXDocument(output.name, binaries, caBundle, created)
+			default:
+				return fmt.Errorf("unknown SBOM format %q", format)
+			}
+			data, err := json.MarshalIndent(doc, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal %s SBOM: %w", format, err)
+			}
+
+			if refs == nil {
+				path := strings.TrimSuffix(out, filepath.Ext(out))
+				if len(outputs) > 1 {
+					path += "." + output.name
+				}
+				path += sbomFormats[format].ext
+
+				slog.Info("writing SBOM", "format", format, "path", path)
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					return fmt.Errorf("failed to write SBOM: %w", err)
+				}
+				continue
+			}
+			blobs = append(blobs, artifactBlob{mediaType: sbomFormats[format].mediaType, data: data})
+		}
+		if refs == nil {
+			continue
+		}
+
+		subject, err := output.descriptor()
+		if err != nil {
+			return fmt.Errorf("failed to describe image: %w", err)
+		}
+		annotations := map[string]string{
+			"org.opencontainers.image.created": created.Format(time.RFC3339),
+		}
+		for _, blob := range blobs {
+			// one artifact per format, so that clients can select SBOMs by artifact type
+			art, err := newArtifact(blob.mediaType, []artifactBlob{blob}, subject, annotations)
+			if err != nil {
+				return fmt.Errorf("failed to create SBOM artifact: %w", err)
+			}
+			if err := pushArtifacts(ctx, refs[i], art); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sbomUUID derives a UUID from the given values, so that identical inputs result in identical documents.
+func sbomUUID(values ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(values, "\x00")))
+	sum[6] = sum[6]&0x0f | 0x50 // version 5 layout, albeit with SHA-256
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(sum[:16])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// sbomInputs returns the values that identify an SBOM document, see sbomUUID.
+func sbomInputs(imageName string, binaries []sbomBinary, caBundle []byte, created time.Time) []string {
+	values := []string{imageName, created.Format(time.RFC3339)}
+	for _, binary := range binaries {
+		values = append(values, binary.service, binary.platform, binary.sha256)
+	}
+	if caBundle != nil {
+		values = append(values, sha256Hex(caBundle))
+	}
+	return values
+}
+
+// sortedModules returns all dependencies of the binaries without duplicates, sorted by their package URL.
+func sortedModules(binaries []sbomBinary) []sbomModule {
+	seen := make(map[string]sbomModule)
+	for _, binary := range binaries {
+		_, deps := binary.modules()
+		for _, dep := range deps {
+			seen[dep.purl()] = dep
+		}
+	}
+	modules := slices.Collect(maps.Values(seen))
+	slices.SortFunc(modules, func(a, b sbomModule) int { return cmp.Compare(a.purl(), b.purl()) })
+	return modules
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string            `json:"name"`
+	SPDXID                string            `json:"SPDXID"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	Checksums             []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+	Comment               string            `json:"comment,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// newSPDXDocument creates an SPDX 2.3 document that describes every binary and the CA bundle. Binaries depend
+// on the modules they were built from.
+func newSPDXDocument(imageName string, binaries []sbomBinary, caBundle []byte, created time.Time) spdxDocument {
+	const noAssertion = "NOASSERTION"
+
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              imageName,
+		DocumentNamespace: "https://spdx.org/spdxdocs/bespoke-" + imageName + "-" + sbomUUID(sbomInputs(imageName, binaries, caBundle, created)...),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.Format(time.RFC3339),
+			Creators: []string{"Tool: bespoke"},
+		},
+	}
+	describe := func(id string) {
+		doc.Relationships = append(doc.Relationships, spdxRelationship{doc.SPDXID, "DESCRIBES", id})
+	}
+	purlRef := func(m sbomModule) []spdxExternalRef {
+		return []spdxExternalRef{{"PACKAGE-MANAGER", "purl", m.purl()}}
+	}
+
+	moduleIDs := make(map[string]string)
+	for i, module := range sortedModules(binaries) {
+		id := fmt.Sprintf("SPDXRef-Module-%d", i+1)
+		moduleIDs[module.purl()] = id
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:                  module.path,
+			SPDXID:                id,
+			VersionInfo:           module.version,
+			DownloadLocation:      noAssertion,
+			PrimaryPackagePurpose: "LIBRARY",
+			ExternalRefs:          purlRef(module),
+		})
+	}
+
+	for i, binary := range binaries {
+		id := fmt.Sprintf("SPDXRef-Service-%d", i+1)
+		main, deps := binary.modules()
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:                  binary.service,
+			SPDXID:                id,
+			VersionInfo:           main.version,
+			DownloadLocation:      noAssertion,
+			PrimaryPackagePurpose: "APPLICATION",
+			Checksums:             []spdxChecksum{{"SHA256", binary.sha256}},
+			ExternalRefs:          purlRef(main),
+			Comment:               fmt.Sprintf("/bin/%s for %s, built from %s with %s", binary.service, binary.platform, binary.info.Path, binary.info.GoVersion),
+		})
+		describe(id)
+		for _, dep := range deps {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{id, "DEPENDS_ON", moduleIDs[dep.purl()]})
+		}
+	}
+
+	if caBundle != nil {
+		const id = "SPDXRef-CABundle"
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:                  "ca-certificates",
+			SPDXID:                id,
+			VersionInfo:           caBundleDate(caBundle),
+			DownloadLocation:      noAssertion,
+			PrimaryPackagePurpose: "FILE",
+			Checksums:             []spdxChecksum{{"SHA256", sha256Hex(caBundle)}},
+			Comment:               caBundlePath,
+		})
+		describe(id)
+	}
+
+	return doc
+}
+
+type cycloneDXDocument struct {
+	BOMFormat    string                `json:"bomFormat"`
+	SpecVersion  string                `json:"specVersion"`
+	SerialNumber string                `json:"serialNumber"`
+	Version      int                   `json:"version"`
+	Metadata     cycloneDXMetadata     `json:"metadata"`
+	Components   []cycloneDXComponent  `json:"components"`
+	Dependencies []cycloneDXDependency `json:"dependencies"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     cycloneDXTools     `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTools struct {
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Hashes     []cycloneDXHash     `json:"hashes,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cycloneDXDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// newCycloneDXDocument creates a CycloneDX 1.5 document for the image, which contains every binary and the
+// CA bundle. Binaries depend on the modules they were built from.
+func newCycloneDXDocument(imageName string, binaries []sbomBinary, caBundle []byte, created time.Time) cycloneDXDocument {
+	const imageRef = "image"
+
+	doc := cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + sbomUUID(sbomInputs(imageName, binaries, caBundle, created)...),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: created.Format(time.RFC3339),
+			Tools: cycloneDXTools{
+				Components: []cycloneDXComponent{{Type: "application", Name: "bespoke"}},
+			},
+			Component: cycloneDXComponent{Type: "container", BOMRef: imageRef, Name: imageName},
+		},
+		Components:   []cycloneDXComponent{},
+		Dependencies: []cycloneDXDependency{},
+	}
+	image := cycloneDXDependency{Ref: imageRef, DependsOn: []string{}}
+
+	for _, binary := range binaries {
+		ref := "service:" + binary.service + ":" + binary.platform
+		main, deps := binary.modules()
+		doc.Components = append(doc.Components, cycloneDXComponent{
+			Type:    "application",
+			BOMRef:  ref,
+			Name:    binary.service,
+			Version: main.version,
+			PURL:    main.purl(),
+			Hashes:  []cycloneDXHash{{"SHA-256", binary.sha256}},
+			Properties: []cycloneDXProperty{
+				{"bespoke:path", "/bin/" + binary.service},
+				{"bespoke:platform", binary.platform},
+				{"go:package", binary.info.Path},
+				{"go:version", binary.info.GoVersion},
+			},
+		})
+		image.DependsOn = append(image.DependsOn, ref)
+
+		dependency := cycloneDXDependency{Ref: ref, DependsOn: []string{}}
+		for _, dep := range deps {
+			dependency.DependsOn = append(dependency.DependsOn, dep.purl())
+		}
+		doc.Dependencies = append(doc.Dependencies, dependency)
+	}
+
+	for _, module := range sortedModules(binaries) {
+		component := cycloneDXComponent{
+			Type:    "library",
+			BOMRef:  module.purl(),
+			Name:    module.path,
+			Version: module.version,
+			PURL:    module.purl(),
+		}
+		if module.sum != "" {
+			component.Properties = []cycloneDXProperty{{"go:sum", module.sum}}
+		}
+		doc.Components = append(doc.Components, component)
+	}
+
+	if caBundle != nil {
+		const ref = "ca-certificates"
+		doc.Components = append(doc.Components, cycloneDXComponent{
+			Type:       "file",
+			BOMRef:     ref,
+			Name:       "ca-certificates",
+			Version:    caBundleDate(caBundle),
+			Hashes:     []cycloneDXHash{{"SHA-256", sha256Hex(caBundle)}},
+			Properties: []cycloneDXProperty{{"bespoke:path", caBundlePath}},
+		})
+		image.DependsOn = append(image.DependsOn, ref)
+	}
+
+	doc.Dependencies = append([]cycloneDXDependency{image}, doc.Dependencies...)
+	return doc
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Signatures are stored the way cosign stores them, so that they can be verified with cosign as well: every
+// signature is a layer of the image tagged sha256-<digest>.sig, whose content is the signed payload and whose
+// annotation holds the signature. See https://github.com/sigstore/cosign/blob/main/specs/SIGNATURE_SPEC.md.
+const (
+	signaturePayloadMediaType types.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	signatureAnnotation                       = "dev.cosignproject.cosign/signature"
+	signatureType                             = "cosign container image signature"
+)
+
+// signaturePayload is the simple signing payload that is signed for an image.
+type signaturePayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+// loadSigningKey reads an unencrypted ECDSA or ed25519 private key from a PEM file, either in PKCS #8 or, for
+// ECDSA, in SEC 1 form.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY":
+		return nil, fmt.Errorf("encrypted cosign keys are not supported, use an unencrypted PKCS #8 key")
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T, expected ECDSA or ed25519", key)
+	}
+}
+
+// loadVerificationKey reads an ECDSA or ed25519 public key from a PEM file in PKIX form, as written by cosign.
+func loadVerificationKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T, expected ECDSA or ed25519", key)
+	}
+}
+
+func readPEMFile(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
+
+// signPayload signs the payload like cosign does: ECDSA keys sign its SHA-256 hash, ed25519 keys sign the
+// payload itself.
+func signPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	hash := sha256.Sum256(payload)
+	return key.Sign(rand.Reader, hash[:], crypto.SHA256)
+}
+
+// verifyPayload is the counterpart of signPayload.
+func verifyPayload(key crypto.PublicKey, payload, signature []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(payload)
+		return ecdsa.VerifyASN1(key, hash[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, signature)
+	default:
+		return false
+	}
+}
+
+// signatureTag returns the tag cosign uses for the signatures of the given digest.
+func signatureTag(ref name.Digest) name.Tag {
+	return ref.Context().Tag(strings.Replace(ref.DigestStr(), ":", "-", 1) + ".sig")
+}
+
+// signImage signs the image or index with the given digest and pushes the signature. Signatures that already
+// exist for the digest are kept.
+func signImage(ctx context.Context, ref name.Digest, key crypto.Signer, opts ...remote.Option) error {
+	var payload signaturePayload
+	payload.Critical.Identity.DockerReference = ref.Context().Name()
+	payload.Critical.Image.DockerManifestDigest = ref.DigestStr()
+	payload.Critical.Type = signatureType
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal signature payload: %w", err)
+	}
+
+	signature, err := signPayload(key, data)
+	if err != nil {
+		return fmt.Errorf("failed to sign image: %w", err)
+	}
+
+	opts = append([]remote.Option{remote.WithContext(ctx)}, opts...)
+	tag := signatureTag(ref)
+
+	sigs, err := remote.Image(tag, opts...)
+	if isNotFound(err) {
+		sigs = mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	} else if err != nil {
+		return fmt.Errorf("failed to get existing signatures: %w", err)
+	}
+
+	sigs, err = mutate.Append(sigs, mutate.Addendum{
+		Layer: static.NewLayer(data, signaturePayloadMediaType),
+		Annotations: map[string]string{
+			signatureAnnotation: base64.StdEncoding.EncodeToString(signature),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add signature: %w", err)
+	}
+
+	slog.Info("pushing signature", "ref", tag.String())
+	if err := remote.Write(tag, sigs, opts...); err != nil {
+		return fmt.Errorf("failed to push signature: %w", err)
+	}
+	return nil
+}
+
+// verifyImage checks that at least one signature of the image or index with the given digest was created by
+// the given key.
+func verifyImage(ctx context.Context, ref name.Digest, key crypto.PublicKey, opts ...remote.Option) error {
+	opts = append([]remote.Option{remote.WithContext(ctx)}, opts...)
+	tag := signatureTag(ref)
+
+	sigs, err := remote.Image(tag, opts...)
+	if isNotFound(err) {
+		return fmt.Errorf("no signatures found for %s", ref)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get signatures: %w", err)
+	}
+	manifest, err := sigs.Manifest()
+	if err != nil {
+		return fmt.Errorf("failed to get signature manifest: %w", err)
+	}
+
+	for _, desc := range manifest.Layers {
+		if desc.MediaType != signaturePayloadMediaType {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(desc.Annotations[signatureAnnotation])
+		if err != nil {
+			slog.Debug("skipping signature with invalid encoding", "digest", desc.Digest, "error", err)
+			continue
+		}
+
+		layer, err := sigs.LayerByDigest(desc.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to get signature payload: %w", err)
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return fmt.Errorf("failed to read signature payload: %w", err)
+		}
+		data, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read signature payload: %w", err)
+		}
+
+		if !verifyPayload(key, data, signature) {
+			continue
+		}
+
+		// the signature is valid, so the payload can be trusted to tell which image it signed
+		var payload signaturePayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return fmt.Errorf("failed to parse signature payload: %w", err)
+		}
+		if payload.Critical.Type != signatureType {
+			continue
+		}
+		if payload.Critical.Image.DockerManifestDigest != ref.DigestStr() {
+			continue // signature was copied from another image
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no valid signature found for %s", ref)
+}
+
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
+
+// signOutputs signs every pushed output in all repositories it was pushed to.
+func signOutputs(ctx context.Context, outputs []imageOutput, refs [][]name.Reference, key crypto.Signer, opts ...remote.Option) error {
+	for i, output := range outputs {
+		desc, err := output.descriptor()
+		if err != nil {
+			return fmt.Errorf("failed to describe image: %w", err)
+		}
+
+		for _, repo := range repositories(refs[i]) {
+			if err := signImage(ctx, repo.Digest(desc.Digest.String()), key, opts...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
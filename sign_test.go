@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestSignVerify(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	repo, err := name.NewRepository(strings.TrimPrefix(server.URL, "http://") + "/test/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// push an image to sign
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(repo.Tag("latest"), image); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := repo.Digest(digest.String())
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, key := range []crypto.Signer{ecdsaKey, ed25519Key} {
+		if err := signImage(ctx, ref, key); err != nil {
+			t.Fatalf("failed to sign with %T: %v", key, err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		ref     name.Digest
+		key     crypto.PublicKey
+		wantErr string
+	}{
+		{name: "ecdsa", ref: ref, key: ecdsaKey.Public()},
+		{name: "ed25519", ref: ref, key: ed25519Key.Public()},
+		{name: "wrong key", ref: ref, key: otherKey.Public(), wantErr: "no valid signature found"},
+		{name: "unsigned image", ref: repo.Digest("sha256:" + strings.Repeat("0", 64)), key: ecdsaKey.Public(), wantErr: "no signatures found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyImage(ctx, tt.ref, tt.key)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verification failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+const (
+	defaultUID = 65532 // same as distroless' nonroot user
+)
+
+// ids returns the configured UID and GID, applying defaults for unset values.
+func (c ConfigImage) ids() (uid, gid int) {
+	uid = defaultUID
+	if c.UID != nil {
+		uid = *c.UID
+	}
+	gid = uid
+	if c.GID != nil {
+		gid = *c.GID
+	}
+	return uid, gid
+}
+
+// createUserLayer creates a layer with /etc/passwd and /etc/group files containing the configured user, as
+// well as the user's home directory owned by the user. The accounts of the image the layer is added to are
+// kept, and root is only added if the image has no /etc/passwd or /etc/group yet.
+func createUserLayer(image v1.Image, cfg ConfigImage, modTime time.Time) (v1.Layer, error) {
+	var (
+		userName  = cfg.UserName
+		groupName = cmp.Or(cfg.GroupName, cfg.UserName)
+		uid, gid  = cfg.ids()
+		home      = "/home/" + userName
+	)
+
+	for _, name := range []string{userName, groupName} {
+		if name == "root" || strings.ContainsAny(name, ":/\n") {
+			return nil, fmt.Errorf("invalid user or group name %q", name)
+		}
+	}
+	if uid <= 0 || gid <= 0 {
+		return nil, fmt.Errorf("uid and gid must be positive, got %d:%d", uid, gid)
+	}
+
+	existing, err := readImageFiles(image, "/etc/passwd", "/etc/group")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accounts of image: %w", err)
+	}
+
+	passwd, err := appendAccount(existing["/etc/passwd"], "root:x:0:0:root:/root:/sbin/nologin",
+		fmt.Sprintf("%s:x:%d:%d::%s:/sbin/nologin", userName, uid, gid, home))
+	if err != nil {
+		return nil, fmt.Errorf("failed to add user to /etc/passwd: %w", err)
+	}
+	group, err := appendAccount(existing["/etc/group"], "root:x:0:",
+		fmt.Sprintf("%s:x:%d:", groupName, gid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to add group to /etc/group: %w", err)
+	}
+
+	return createTarLayerFromEntries([]tarEntry{
+		{path: "/etc", mode: 0755, dir: true},
+		{path: "/etc/passwd", data: passwd, mode: 0644},
+		{path: "/etc/group", data: group, mode: 0644},
+		{path: "/home", mode: 0755, dir: true},
+		{path: home, mode: 0700, uid: uid, gid: gid, dir: true},
+	}, modTime)
+}
+
+// appendAccount adds the entry to the passwd or group file content. A file that does not exist yet starts
+// with root. If an account with the same name exists, it has to have the same id, in which case the file is
+// kept as is.
+func appendAccount(content []byte, root, entry string) ([]byte, error) {
+	if content == nil {
+		content = []byte(root + "\n")
+	}
+
+	name, rest, _ := strings.Cut(entry, ":")
+	id := strings.SplitN(rest, ":", 3)[1]
+	for line := range strings.Lines(string(content)) {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 4)
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		if fields[2] != id {
+			return nil, fmt.Errorf("%s already exists with id %s instead of %s", name, fields[2], id)
+		}
+		return content, nil
+	}
+
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+	return append(content, entry+"\n"...), nil
+}
+
+// readImageFiles returns the contents of the given absolute paths in the image's file system. Paths that do
+// not exist or are not regular files are missing from the result.
+func readImageFiles(image v1.Image, paths ...string) (map[string][]byte, error) {
+	rc := mutate.Extract(image)
+	defer rc.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		p := path.Join("/", hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !slices.Contains(paths, p) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[p] = data
+	}
+	return files, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+func TestCreateUserLayer(t *testing.T) {
+	uid := 1000
+	cfg := ConfigImage{UserName: "app", UID: &uid}
+
+	withFiles := func(passwd, group string) v1.Image {
+		t.Helper()
+		layer, err := createTarLayerFromEntries([]tarEntry{
+			{path: "/etc", mode: 0755, dir: true},
+			{path: "/etc/passwd", data: []byte(passwd), mode: 0644},
+			{path: "/etc/group", data: []byte(group), mode: 0644},
+		}, time.Unix(0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		image, err := mutate.AppendLayers(empty.Image, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return image
+	}
+
+	tests := []struct {
+		name       string
+		base       v1.Image
+		wantPasswd string
+		wantGroup  string
+		wantErr    bool
+	}{
+		{
+			name:       "empty base",
+			base:       empty.Image,
+			wantPasswd: "root:x:0:0:root:/root:/sbin/nologin\napp:x:1000:1000::/home/app:/sbin/nologin\n",
+			wantGroup:  "root:x:0:\napp:x:1000:\n",
+		},
+		{
+			name:       "keeps accounts of base",
+			base:       withFiles("root:x:0:0:root:/root:/bin/sh\nnobody:x:65534:65534::/:/sbin/nologin", "root:x:0:\n"),
+			wantPasswd: "root:x:0:0:root:/root:/bin/sh\nnobody:x:65534:65534::/:/sbin/nologin\napp:x:1000:1000::/home/app:/sbin/nologin\n",
+			wantGroup:  "root:x:0:\napp:x:1000:\n",
+		},
+		{
+			name:       "user exists with same id",
+			base:       withFiles("app:x:1000:1000::/srv:/bin/sh\n", "app:x:1000:\n"),
+			wantPasswd: "app:x:1000:1000::/srv:/bin/sh\n",
+			wantGroup:  "app:x:1000:\n",
+		},
+		{
+			name:    "user exists with other id",
+			base:    withFiles("app:x:1001:1001::/srv:/bin/sh\n", ""),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layer, err := createUserLayer(tt.base, cfg, time.Unix(0, 0))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			image, err := mutate.AppendLayers(tt.base, layer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := readImageFiles(image, "/etc/passwd", "/etc/group")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(files["/etc/passwd"]); got != tt.wantPasswd {
+				t.Errorf("/etc/passwd = %q, want %q", got, tt.wantPasswd)
+			}
+			if got := string(files["/etc/group"]); got != tt.wantGroup {
+				t.Errorf("/etc/group = %q, want %q", got, tt.wantGroup)
+			}
+		})
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/sync/errgroup"
+)
+
+var validateCmd = &cli.Command{
+	Name:  "validate",
+	Usage: "check the config file for mistakes",
+	Description: `
+		Reports unknown keys, service names that cannot be used as /bin/<name>, packages that do not exist or are not main packages,
+		and platforms that are not supported by the go command, together with their position in the config file.
+		The same checks run at the start of every build.
+	`,
+	Action: validateAction,
+}
+
+// validServiceName matches names that can be used as file names in /bin.
+var validServiceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func validateAction(ctx context.Context, c *cli.Command) error {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := validateConfig(ctx, cfg); err != nil {
+		return err
+	}
+	slog.Info("config is valid", "path", cfg.path, "services", len(cfg.Services))
+	return nil
+}
+
+// configProblem is a mistake in the config file. Line is 0 if the position is unknown.
+type configProblem struct {
+	line int
+	msg  string
+}
+
+// validateConfig reports all problems of the config at once, so that they can be fixed in one go.
+func validateConfig(ctx context.Context, cfg Config) error {
+	positions := scanConfigPositions(cfg.raw)
+
+	var problems []configProblem
+	report := func(line int, format string, args ...any) {
+		problems = append(problems, configProblem{line: line, msg: fmt.Sprintf(format, args...)})
+	}
+
+	// the toml package matches keys case-insensitively, but only the exact spelling is documented, and keys
+	// that do not exist at all are ignored; the keys of unknown tables are reported through the table
+	unknown := make(map[string]bool)
+	for _, key := range cfg.keys {
+		k := joinConfigKey(key)
+		if unknown[k] || (len(key) > 1 && unknown[joinConfigKey(key[:len(key)-1])]) {
+			continue
+		}
+		known, suggestion := lookupConfigKey(reflect.TypeFor[Config](), key)
+		if known {
+			continue
+		}
+		unknown[k] = true
+
+		msg := fmt.Sprintf("unknown key %s", key)
+		if suggestion != "" {
+			msg += fmt.Sprintf(", did you mean %s?", suggestion)
+		}
+		lines := positions.lines(k)
+		if len(lines) == 0 {
+			lines = []int{0}
+		}
+		for _, line := range lines {
+			report(line, "%s", msg)
+		}
+	}
+
+	if len(cfg.Services) == 0 {
+		report(0, "no services defined")
+	}
+
+	supported, err := goPlatforms(ctx)
+	if err != nil {
+		return err
+	}
+	isSupported := func(p v1.Platform) bool {
+		return slices.ContainsFunc(supported, func(s v1.Platform) bool {
+			return s.OS == p.OS && s.Architecture == p.Architecture
+		})
+	}
+
+	var checks []packageCheck
+	for i, svc := range cfg.mergedServices() {
+		if !validServiceName.MatchString(svc.Name) {
+			report(positions.serviceLine(i, "name"), "invalid service name %q, must match %s to be used as /bin/<name>", svc.Name, validServiceName)
+		}
+
+		var platforms []v1.Platform
+		if svc.Platforms != nil {
+			for _, s := range *svc.Platforms {
+				platform, err := v1.ParsePlatform(s)
+				if err != nil {
+					report(positions.serviceLine(i, "platforms"), "service %s: invalid platform %q: %v", svc.Name, s, err)
+					continue
+				}
+				platforms = append(platforms, *platform)
+			}
+		} else {
+			platforms = append(platforms, v1.Platform{
+				OS:           cmp.Or(svc.GOOS, runtime.GOOS),
+				Architecture: cmp.Or(svc.GOARCH, runtime.GOARCH),
+			})
+		}
+		platformsOK := true
+		for _, platform := range platforms {
+			if !isSupported(platform) {
+				key := "platforms"
+				if svc.Platforms == nil {
+					key = "GOARCH"
+					if !slices.ContainsFunc(supported, func(s v1.Platform) bool { return s.OS == platform.OS }) {
+						key = "GOOS"
+					}
+				}
+				report(positions.serviceLine(i, key), "service %s: unsupported platform %s/%s", svc.Name, platform.OS, platform.Architecture)
+				platformsOK = false
+			}
+		}
+
+		if svc.Package == "" {
+			report(positions.serviceLine(i, "package"), "service %s has no package", svc.Name)
+			continue
+		}
+		if platformsOK && len(platforms) > 0 {
+			checks = append(checks, packageCheck{service: i, svc: svc, platform: platforms[0]})
+		}
+	}
+
+	var defaults []string
+	for i, svc := range cfg.Services {
+		if svc.Default {
+			defaults = append(defaults, svc.Name)
+			if len(defaults) > 1 {
+				report(positions.serviceLine(i, "default"), "service %s is marked as default, but so is %s, only one service can be the default", svc.Name, defaults[0])
+			}
+		}
+	}
+
+	for name, profile := range cfg.Profiles {
+		for svcName := range profile.Services {
+			if !slices.ContainsFunc(cfg.Services, func(svc ConfigService) bool { return svc.Name == svcName }) {
+				report(positions.line("profiles."+name+".services."+svcName), "profile %s: service %s is not defined", name, svcName)
+			}
+		}
+	}
+
+	for _, check := range checkPackages(ctx, cfg.ProjectRoot, checks) {
+		if check.problem != "" {
+			report(positions.serviceLine(check.service, "package"), "service %s: %s", check.svc.Name, check.problem)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(problems, func(a, b configProblem) int { return cmp.Compare(a.line, b.line) })
+	errs := make([]error, len(problems))
+	for i, p := range problems {
+		if p.line == 0 {
+			errs[i] = fmt.Errorf("%s: %s", cfg.path, p.msg)
+		} else {
+			errs[i] = fmt.Errorf("%s:%d: %s", cfg.path, p.line, p.msg)
+		}
+	}
+	return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+}
+
+// lookupConfigKey reports whether key exists in the config structure t with the exact spelling of its toml
+// tags. If it only exists with a different case, the correct spelling of the last part is suggested.
+func lookupConfigKey(t reflect.Type, key []string) (known bool, suggestion string) {
+	for i, part := range key {
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Map {
+			t = t.Elem() // any key is valid, e.g. the name of a profile
+			continue
+		}
+		if t.Kind() != reflect.Struct {
+			return false, ""
+		}
+
+		field, ok := configField(t, part)
+		if !ok {
+			return false, ""
+		}
+		if tag := configFieldName(field); tag != part {
+			if i == len(key)-1 {
+				return false, tag
+			}
+			return false, ""
+		}
+		t = field.Type
+	}
+	return true, ""
+}
+
+// configField returns the field of struct t whose toml key is name, ignoring case like the toml package does.
+// Embedded structs are searched as well.
+func configField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() || field.Tag.Get("toml") == "-" {
+			continue
+		}
+		if field.Anonymous && field.Tag.Get("toml") == "" {
+			if f, ok := configField(field.Type, name); ok {
+				return f, true
+			}
+			continue
+		}
+		if strings.EqualFold(configFieldName(field), name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func configFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	return cmp.Or(name, field.Name)
+}
+
+// packageCheck verifies that the package of a service exists and is a main package for the given platform.
+type packageCheck struct {
+	service  int
+	svc      ConfigService
+	platform v1.Platform
+	problem  string
+}
+
+func checkPackages(ctx context.Context, projectRoot string, checks []packageCheck) []packageCheck {
+	var g errgroup.Group
+	g.SetLimit(runtime.NumCPU())
+	for i := range checks {
+		check := &checks[i]
+		g.Go(func() error {
+			check.problem = checkPackage(ctx, projectRoot, check.svc, check.platform)
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return checks
+}
+
+func checkPackage(ctx context.Context, projectRoot string, svc ConfigService, platform v1.Platform) string {
+	args := []string{"list", "-e", "-json=ImportPath,Name,Error"}
+	if svc.Tags != nil && len(*svc.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(*svc.Tags, ","))
+	}
+	args = append(args, svc.Package)
+
+	cmd := exec.CommandContext(ctx, goBinary(), args...)
+	cmd.Dir = projectRoot
+	cmd.Env = append(os.Environ(), "GOOS="+platform.OS, "GOARCH="+platform.Architecture)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Sprintf("failed to list package %s: %s", svc.Package, cmp.Or(string(bytes.TrimSpace(stderr.Bytes())), err.Error()))
+	}
+
+	var pkg struct {
+		ImportPath string
+		Name       string
+		Error      *struct {
+			Err string
+		}
+	}
+	if err := json.Unmarshal(out, &pkg); err != nil {
+		return fmt.Sprintf("failed to parse go list output: %v", err)
+	}
+	switch {
+	case pkg.Error != nil:
+		return fmt.Sprintf("package %s: %s", svc.Package, pkg.Error.Err)
+	case pkg.Name != "main":
+		return fmt.Sprintf("package %s is not a main package (package %s)", svc.Package, pkg.Name)
+	default:
+		return ""
+	}
+}
+
+// configPositions maps keys of a config file to the lines they are defined in.
+type configPositions struct {
+	keys     []configKeyPosition
+	services []int // line of every [[services]] header
+}
+
+type configKeyPosition struct {
+	key     string // dotted key without array indices, e.g. services.image.cmd
+	service int    // index of the enclosing [[services]] entry, or -1
+	line    int
+}
+
+var (
+	configTableHeader = regexp.MustCompile(`^\[\[?\s*([^\[\]]+?)\s*\]\]?`)
+	configKeyValue    = regexp.MustCompile(`^((?:[A-Za-z0-9_-]+|"[^"]*"|'[^']*')(?:\s*\.\s*(?:[A-Za-z0-9_-]+|"[^"]*"|'[^']*'))*)\s*=`)
+)
+
+// scanConfigPositions finds table headers and keys line by line. This does not cover all of TOML, e.g. keys
+// of inline tables are attributed to the key of the table, but it is enough to point at mistakes.
+func scanConfigPositions(raw []byte) configPositions {
+	var (
+		positions configPositions
+		table     string
+		service   = -1
+		multiline string // delimiter of the multi-line string the current line is in
+	)
+	for i, line := range strings.Split(string(raw), "\n") {
+		lineNo := i + 1
+		line = strings.TrimSpace(line)
+
+		if multiline != "" {
+			if strings.Contains(line, multiline) {
+				multiline = ""
+			}
+			continue
+		}
+
+		if m := configTableHeader.FindStringSubmatch(line); m != nil {
+			table = joinConfigKey(splitConfigKey(m[1]))
+			if table == "services" && strings.HasPrefix(line, "[[") {
+				positions.services = append(positions.services, lineNo)
+				service = len(positions.services) - 1
+			} else if table != "services" && !strings.HasPrefix(table, "services.") {
+				service = -1
+			}
+			positions.keys = append(positions.keys, configKeyPosition{key: table, service: service, line: lineNo})
+			continue
+		}
+
+		if m := configKeyValue.FindStringSubmatch(line); m != nil {
+			key := joinConfigKey(splitConfigKey(m[1]))
+			if table != "" {
+				key = table + "." + key
+			}
+			positions.keys = append(positions.keys, configKeyPosition{key: key, service: service, line: lineNo})
+
+			for _, delim := range []string{`"""`, `'''`} {
+				if strings.Count(line, delim)%2 == 1 {
+					multiline = delim
+				}
+			}
+		}
+	}
+	return positions
+}
+
+// lines returns all lines the key is defined in. If it is not found, the lines of its closest parent are
+// returned, e.g. for keys within inline tables.
+func (p configPositions) lines(key string) []int {
+	for ; key != ""; key = parentConfigKey(key) {
+		var lines []int
+		for _, pos := range p.keys {
+			if pos.key == key {
+				lines = append(lines, pos.line)
+			}
+		}
+		if len(lines) > 0 {
+			return lines
+		}
+	}
+	return nil
+}
+
+// line returns the first line the key is defined in, or 0.
+func (p configPositions) line(key string) int {
+	if lines := p.lines(key); len(lines) > 0 {
+		return lines[0]
+	}
+	return 0
+}
+
+// serviceLine returns the line in which a setting of a service is defined. Settings that are inherited
+// from the defaults point at the defaults, and settings that are not defined at all at the service.
+func (p configPositions) serviceLine(service int, key string) int {
+	for k := "services." + key; k != "services"; k = parentConfigKey(k) {
+		for _, pos := range p.keys {
+			if pos.service == service && pos.key == k {
+				return pos.line
+			}
+		}
+	}
+	for k := "defaults." + key; k != "defaults"; k = parentConfigKey(k) {
+		for _, pos := range p.keys {
+			if pos.key == k {
+				return pos.line
+			}
+		}
+	}
+	if service < len(p.services) {
+		return p.services[service]
+	}
+	return 0
+}
+
+func parentConfigKey(key string) string {
+	i := strings.LastIndex(key, ".")
+	if i < 0 {
+		return ""
+	}
+	return key[:i]
+}
+
+// splitConfigKey splits a dotted TOML key into its parts and removes quotes.
+func splitConfigKey(key string) []string {
+	var (
+		parts []string
+		part  strings.Builder
+		quote rune
+	)
+	for _, r := range key {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			part.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, strings.TrimSpace(part.String()))
+}
+
+func joinConfigKey(parts []string) string {
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitConfigKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{key: "GOOS", want: []string{"GOOS"}},
+		{key: "image.cmd", want: []string{"image", "cmd"}},
+		{key: "image . cmd", want: []string{"image", "cmd"}},
+		{key: `services."my svc".image`, want: []string{"services", "my svc", "image"}},
+		{key: `"a.b".c`, want: []string{"a.b", "c"}},
+		{key: `'x "y"'.z`, want: []string{`x "y"`, "z"}},
+	}
+	for _, tt := range tests {
+		if got := splitConfigKey(tt.key); !slices.Equal(got, tt.want) {
+			t.Errorf("splitConfigKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+const testConfigPositions = `withoutCABundle = true
+
+[defaults]
+GOOS = "linux"
+image.cmd = ["x"]
+"GOARCH" = "amd64"
+
+[[services]]
+name = "a"
+image = { cmd = ["a"], user = "app" }
+
+[[ services ]]
+name = "b"
+description = """
+name = "not a key"
+"""
+[services.image]
+cmd = ["b"]
+
+[profiles.prod.services."b"]
+GOOS = "darwin"
+`
+
+func TestScanConfigPositions(t *testing.T) {
+	positions := scanConfigPositions([]byte(testConfigPositions))
+
+	if want := []int{8, 12}; !slices.Equal(positions.services, want) {
+		t.Errorf("services = %v, want %v", positions.services, want)
+	}
+
+	t.Run("lines", func(t *testing.T) {
+		tests := []struct {
+			key  string
+			want []int
+		}{
+			{key: "withoutCABundle", want: []int{1}},
+			{key: "defaults", want: []int{3}},
+			{key: "defaults.GOOS", want: []int{4}},
+			{key: "defaults.image.cmd", want: []int{5}},
+			{key: "defaults.GOARCH", want: []int{6}},
+			{key: "services", want: []int{8, 12}},
+			{key: "services.name", want: []int{9, 13}},        // not within the multi-line string
+			{key: "services.image.user", want: []int{10, 17}}, // inline table and table of the parent
+			{key: "services.image.cmd", want: []int{18}},
+			{key: "profiles.prod.services.b.GOOS", want: []int{21}},   // quoted key
+			{key: "profiles.prod.services.b.GOARCH", want: []int{20}}, // parent table
+			{key: "unknown", want: nil},
+		}
+		for _, tt := range tests {
+			if got := positions.lines(tt.key); !slices.Equal(got, tt.want) {
+				t.Errorf("lines(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("serviceLine", func(t *testing.T) {
+		tests := []struct {
+			service int
+			key     string
+			want    int
+		}{
+			{service: 0, key: "name", want: 9},
+			{service: 1, key: "name", want: 13},
+			{service: 0, key: "image.cmd", want: 10}, // inline table
+			{service: 1, key: "image.cmd", want: 18},
+			{service: 1, key: "image.user", want: 17}, // table of the parent
+			{service: 0, key: "GOOS", want: 4},        // inherited from the defaults
+			{service: 1, key: "GOARCH", want: 6},      // quoted key in the defaults
+			{service: 0, key: "package", want: 8},     // not defined, points at the service
+			{service: 2, key: "package", want: 0},
+		}
+		for _, tt := range tests {
+			if got := positions.serviceLine(tt.service, tt.key); got != tt.want {
+				t.Errorf("serviceLine(%d, %q) = %d, want %d", tt.service, tt.key, got, tt.want)
+			}
+		}
+	})
+}
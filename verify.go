@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/urfave/cli/v3"
+)
+
+var verifyCmd = &cli.Command{
+	Name:      "verify",
+	Usage:     "verify the signature of a pushed image",
+	ArgsUsage: "<reference>",
+	Action:    verifyAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "key",
+			Usage:    "path to the PEM encoded ECDSA or ed25519 public key the image was signed with",
+			Required: true,
+		},
+	},
+}
+
+func verifyAction(ctx context.Context, c *cli.Command) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("expected exactly one image reference")
+	}
+
+	key, err := loadVerificationKey(c.String("key"))
+	if err != nil {
+		return fmt.Errorf("failed to load public key: %w", err)
+	}
+
+	ref, err := name.ParseReference(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to parse reference: %w", err)
+	}
+
+	opts := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+
+	// signatures belong to digests, so tags have to be resolved first
+	digest, ok := ref.(name.Digest)
+	if !ok {
+		desc, err := remote.Head(ref, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", ref, err)
+		}
+		digest = ref.Context().Digest(desc.Digest.String())
+	}
+
+	if err := verifyImage(ctx, digest, key, opts...); err != nil {
+		return err
+	}
+
+	slog.Info("signature verified", "ref", digest.String())
+	return nil
+}
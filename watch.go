@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"syscall"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/sync/errgroup"
+)
+
+var watchCmd = &cli.Command{
+	Name:      "watch",
+	Usage:     "run services locally and rebuild and restart them when their sources change",
+	ArgsUsage: "[service...]",
+	Description: `
+		Runs the given services, or all services, like the run command does.
+		The Go files, go.mod and go.sum of all local packages in a service's dependency closure are watched for changes.
+		Once no more changes occur for the debounce duration, the affected services are rebuilt and restarted with SIGTERM.
+		If a build fails, the service keeps running with its previous binary.
+	`,
+	Action: watchAction,
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "debounce",
+			Usage: "time without further changes before services are rebuilt",
+			Value: 300 * time.Millisecond,
+		},
+		&cli.DurationFlag{
+			Name:  "poll-interval",
+			Usage: "interval in which source files are checked for changes",
+			Value: 250 * time.Millisecond,
+		},
+		&cli.DurationFlag{
+			Name:  "grace-period",
+			Usage: "time services get to shut down after SIGTERM before they are killed",
+			Value: 10 * time.Second,
+		},
+		&cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "rebuild binaries instead of reusing unchanged ones from the cache (BESPOKE_CACHE_DIR)",
+		},
+	},
+}
+
+// fileState identifies a version of a file or directory. A missing file has the zero state.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchedService is a service that runs locally and is restarted whenever its sources change.
+type watchedService struct {
+	svc    ConfigService
+	binary builtBinary
+	files  map[string]fileState // source files and their directories, whose times change if files are added
+
+	cmd  *exec.Cmd
+	done chan struct{} // closed when cmd exited
+}
+
+func watchAction(ctx context.Context, c *cli.Command) error {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	services := cfg.mergedServices()
+	if c.Args().Present() {
+		var selected []ConfigService
+		for _, name := range c.Args().Slice() {
+			svc, err := findService(services, name)
+			if err != nil {
+				return err
+			}
+			selected = append(selected, svc)
+		}
+		services = selected
+	}
+	if len(services) == 0 {
+		return fmt.Errorf("no services found in config")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	binOpts := localBinaryOptions(ctx, cfg, c.Bool("no-cache"))
+	binaries, err := buildBinaries(ctx, services, []*v1.Platform{hostPlatform()}, binOpts, runtime.NumCPU())
+	if err != nil {
+		return err
+	}
+
+	grace := c.Duration("grace-period")
+	watched := make([]*watchedService, len(services))
+	defer func() {
+		for _, w := range watched {
+			if w != nil {
+				w.stop(grace)
+				_ = os.Remove(w.binary.path)
+			}
+		}
+	}()
+	for i, svc := range services {
+		watched[i] = &watchedService{svc: svc, binary: binaries[0][i]}
+		if err := watched[i].start(ctx, cfg.ProjectRoot); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(c.Duration("poll-interval"))
+	defer ticker.Stop()
+
+	var (
+		pending    = make(map[*watchedService]bool)
+		lastChange time.Time
+	)
+	for {
+		select {
+		case sig := <-signals:
+			slog.Info("stopping services", "signal", sig)
+			return nil
+
+		case <-ticker.C:
+			for _, w := range watched {
+				if w.changed() {
+					pending[w] = true
+					lastChange = time.Now()
+				}
+			}
+			if len(pending) == 0 || time.Since(lastChange) < c.Duration("debounce") {
+				continue // wait for rapid saves to settle
+			}
+
+			var rebuild []*watchedService
+			for _, w := range watched {
+				if pending[w] {
+					rebuild = append(rebuild, w)
+				}
+			}
+			clear(pending)
+			rebuildServices(ctx, rebuild, binOpts, grace, cfg.ProjectRoot)
+		}
+	}
+}
+
+// rebuildServices builds the services concurrently and restarts every service whose build succeeded.
+func rebuildServices(ctx context.Context, watched []*watchedService, opts binaryOptions, grace time.Duration, projectRoot string) {
+	binaries := make([]builtBinary, len(watched))
+	errs := make([]error, len(watched))
+
+	var g errgroup.Group
+	g.SetLimit(runtime.NumCPU())
+	for i, w := range watched {
+		slog.Info("sources changed, rebuilding service", "service", w.svc.Name)
+		g.Go(func() error {
+			binaries[i], errs[i] = buildBinary(ctx, w.svc, hostPlatform(), opts)
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	for i, w := range watched {
+		if errs[i] != nil {
+			slog.Error("failed to rebuild service, keeping previous binary", "service", w.svc.Name, "error", errs[i])
+			continue
+		}
+
+		w.stop(grace)
+		_ = os.Remove(w.binary.path)
+		w.binary = binaries[i]
+		if err := w.start(ctx, projectRoot); err != nil {
+			slog.Error("failed to restart service", "service", w.svc.Name, "error", err)
+		}
+	}
+}
+
+// start lists the service's source files and starts its binary.
+func (w *watchedService) start(ctx context.Context, projectRoot string) error {
+	files, err := sourceFiles(ctx, w.binary, projectRoot)
+	if err != nil {
+		return fmt.Errorf("failed to list source files of service %s: %w", w.svc.Name, err)
+	}
+	w.files = make(map[string]fileState, len(files))
+	for _, file := range files {
+		w.files[file] = statFile(file)
+	}
+
+	if err := makeExecutable(w.binary.path); err != nil {
+		return err
+	}
+
+	args := []string{}
+	if w.svc.Image.Cmd != nil {
+		args = *w.svc.Image.Cmd
+	}
+	stdout := newPrefixWriter(os.Stdout, w.svc.Name)
+	stderr := newPrefixWriter(os.Stderr, w.svc.Name)
+
+	w.cmd = exec.Command(w.binary.path, args...)
+	w.cmd.Stdout = stdout
+	w.cmd.Stderr = stderr
+	w.cmd.Env = serviceEnv(w.svc)
+
+	slog.Info("starting service", "service", w.svc.Name, "args", args)
+	if err := w.cmd.Start(); err != nil {
+		w.cmd = nil
+		return fmt.Errorf("failed to start service %s: %w", w.svc.Name, err)
+	}
+
+	w.done = make(chan struct{})
+	go func(cmd *exec.Cmd, done chan struct{}) {
+		defer close(done)
+		err := cmd.Wait()
+		stdout.Flush()
+		stderr.Flush()
+
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			slog.Warn("service failed", "service", w.svc.Name, "error", err)
+			return
+		}
+		slog.Info("service exited", "service", w.svc.Name, "status", cmd.ProcessState.String())
+	}(w.cmd, w.done)
+
+	return nil
+}
+
+// stop sends SIGTERM to the service, so that it can shut down gracefully, and kills it if it is still
+// running after the grace period.
+func (w *watchedService) stop(grace time.Duration) {
+	if w.cmd == nil {
+		return
+	}
+	defer func() { w.cmd = nil }()
+
+	select {
+	case <-w.done:
+		return // exited on its own
+	default:
+	}
+
+	slog.Info("stopping service", "service", w.svc.Name)
+	_ = w.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-w.done:
+	case <-time.After(grace):
+		slog.Warn("service did not stop in time, killing it", "service", w.svc.Name, "gracePeriod", grace)
+		_ = w.cmd.Process.Kill()
+		<-w.done
+	}
+}
+
+// changed reports whether any source file changed since the last call or since the service was started.
+func (w *watchedService) changed() bool {
+	changed := false
+	for file, state := range w.files {
+		if current := statFile(file); current != state {
+			w.files[file] = current
+			changed = true
+		}
+	}
+	return changed
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}
+}
+
+// sourceFiles returns the files and directories of all local packages in the dependency closure of the
+// binary, including go.mod and go.sum of their modules. Packages from the module cache are immutable and
+// therefore skipped.
+func sourceFiles(ctx context.Context, binary builtBinary, projectRoot string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, goBinary(), slices.Concat([]string{"list", "-deps", "-json"}, binary.args[1:])...)
+	cmd.Dir = projectRoot
+	cmd.Env = append(os.Environ(), binary.env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run go list: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var (
+		files []string
+		seen  = make(map[string]bool)
+	)
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pkg goListPackage
+		if err := dec.Decode(&pkg); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse go list output: %w", err)
+		}
+
+		if pkg.Standard {
+			continue
+		}
+		if mod := pkg.Module; mod != nil && !mod.Main && (mod.Replace == nil || mod.Replace.Version != "") {
+			continue
+		}
+
+		if mod := pkg.Module; mod != nil && mod.GoMod != "" {
+			add(mod.GoMod)
+			add(filepath.Join(filepath.Dir(mod.GoMod), "go.sum"))
+		}
+		add(pkg.Dir)
+		for _, file := range slices.Concat(pkg.GoFiles, pkg.CgoFiles, pkg.CFiles, pkg.CXXFiles, pkg.MFiles, pkg.HFiles,
+			pkg.FFiles, pkg.SFiles, pkg.SwigFiles, pkg.SwigCXXFiles, pkg.SysoFiles, pkg.EmbedFiles) {
+			add(filepath.Join(pkg.Dir, file))
+		}
+	}
+
+	return files, nil
+}